@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// changeStreamUnsupportedCode is the MongoDB error code of $changeStream on a standalone server.
+	changeStreamUnsupportedCode = 40573
+	// changeStreamHistoryLostCode is the MongoDB error code of a resume token older than the oplog.
+	changeStreamHistoryLostCode = 286
+)
+
+// Watch modes of the AdWatcher.
+const (
+	watchAuto         = "auto"
+	watchChangeStream = "changestream"
+	watchPoll         = "poll"
+	watchOff          = "off"
+)
+
+// watchState is the progress of an AdWatcher, saved so it resumes where it stopped after a restart.
+type watchState struct {
+	ID          string   `bson:"_id"`
+	ResumeToken bson.Raw `bson:"resumeToken,omitempty"`
+	// Revision is the last polled count of writes to the ads collection.
+	Revision int64 `bson:"revision,omitempty"`
+}
+
+// AdWatcher follows the changes made to the ads collection by every instance
+// and calls onChange after them, so in-process indexes and caches stay coherent.
+// It reads a change stream when the deployment supports them, and otherwise
+// polls the revision counted by the MongoDB store after every write.
+type AdWatcher struct {
+	// onChange is called after one or more ads changed.
+	onChange func()
+	// instance identifies the saved state of this instance.
+	instance string
+	state    *watchState
+
+	mu      sync.Mutex
+	started bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewAdWatcher returns a watcher calling onChange after ads change.
+func NewAdWatcher(onChange func()) *AdWatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	instance, err := os.Hostname()
+	if err != nil {
+		instance = "default"
+	}
+	return &AdWatcher{
+		onChange: onChange,
+		instance: instance,
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+}
+
+// Start watches in the background until Close, restarting with backoff after errors.
+func (w *AdWatcher) Start() {
+	w.mu.Lock()
+	w.started = true
+	w.mu.Unlock()
+	go w.run()
+}
+
+func (w *AdWatcher) run() {
+	defer close(w.done)
+
+	mode := cfg.WatchMode
+	backoff := time.Duration(cfg.ReconnectMinBackoff)
+	for {
+		start := time.Now()
+		var err error
+		if mode == watchPoll {
+			err = w.poll()
+		} else {
+			err = w.watch()
+		}
+		if w.ctx.Err() != nil {
+			return
+		}
+		if mode == watchAuto && isChangeStreamUnsupported(err) {
+			slog.Info("change streams are not supported, polling ads for changes")
+			mode = watchPoll
+			continue
+		}
+
+		// Start over with short delays after watching for a while
+		if time.Since(start) > time.Duration(cfg.ReconnectMaxBackoff) {
+			backoff = time.Duration(cfg.ReconnectMinBackoff)
+		}
+		delay := jitter(backoff)
+		backoff = nextBackoff(backoff, time.Duration(cfg.ReconnectMaxBackoff))
+		slog.Warn("stopped watching ads", "mode", mode, "retryIn", delay.String(), "error", err)
+		if !w.sleep(delay) {
+			return
+		}
+	}
+}
+
+// watch reads the change stream of the ads collection until it fails.
+func (w *AdWatcher) watch() error {
+	col, err := mongoConn.Collection()
+	if err != nil {
+		return err
+	}
+	state, err := w.loadState()
+	if err != nil {
+		return err
+	}
+
+	opts := options.ChangeStream()
+	if state.ResumeToken != nil {
+		opts.SetStartAfter(state.ResumeToken)
+	}
+	stream, err := col.Watch(w.ctx, mongo.Pipeline{}, opts)
+	if isChangeStreamHistoryLost(err) {
+		// The changes since the saved token are unknown
+		slog.Warn("change stream cannot resume, watching from now")
+		w.onChange()
+		stream, err = col.Watch(w.ctx, mongo.Pipeline{})
+	}
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+	w.saveResumeToken(stream.ResumeToken())
+
+	for stream.Next(w.ctx) {
+		adChangeEvents.WithLabelValues(watchChangeStream).Inc()
+		// Notify once for the changes already received
+		for stream.TryNext(w.ctx) {
+			adChangeEvents.WithLabelValues(watchChangeStream).Inc()
+		}
+		if err := stream.Err(); err != nil {
+			return err
+		}
+		w.onChange()
+		w.saveResumeToken(stream.ResumeToken())
+	}
+	return stream.Err()
+}
+
+// poll checks the revision of the ads every poll interval until it fails.
+func (w *AdWatcher) poll() error {
+	col, err := w.stateCollection()
+	if err != nil {
+		return err
+	}
+	state, err := w.loadState()
+	if err != nil {
+		return err
+	}
+
+	// Without saved progress, only changes from now on are reported
+	if state.Revision == 0 {
+		latest, err := adsRevision(w.ctx, col)
+		if err != nil {
+			return err
+		}
+		w.saveRevision(latest)
+	}
+
+	ticker := time.NewTicker(time.Duration(cfg.WatchPollInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.ctx.Done():
+			return w.ctx.Err()
+		case <-ticker.C:
+		}
+		latest, err := adsRevision(w.ctx, col)
+		if err != nil {
+			return err
+		}
+		// The counter starts over if its document is removed
+		if latest != state.Revision {
+			adChangeEvents.WithLabelValues(watchPoll).Inc()
+			w.onChange()
+			w.saveRevision(latest)
+		}
+	}
+}
+
+// adsRevision returns the number of writes to the ads collection counted by recordChange.
+func adsRevision(ctx context.Context, col *mongo.Collection) (int64, error) {
+	var doc struct {
+		Revision int64 `bson:"revision"`
+	}
+	err := col.FindOne(ctx, bson.M{"_id": adsRevisionID}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	return doc.Revision, err
+}
+
+// stateCollection returns the collection of the saved watch states.
+func (w *AdWatcher) stateCollection() (*mongo.Collection, error) {
+	client, err := mongoConn.Client()
+	if err != nil {
+		return nil, err
+	}
+	return client.Database(cfg.DBName).Collection(cfg.WatchStateCollectionName), nil
+}
+
+// loadState returns the progress of the watcher, read from the database the first time.
+func (w *AdWatcher) loadState() (*watchState, error) {
+	if w.state != nil {
+		return w.state, nil
+	}
+	col, err := w.stateCollection()
+	if err != nil {
+		return nil, err
+	}
+	state := &watchState{ID: w.instance}
+	err = col.FindOne(w.ctx, bson.M{"_id": w.instance}).Decode(state)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	w.state = state
+	return state, nil
+}
+
+func (w *AdWatcher) saveResumeToken(token bson.Raw) {
+	if token == nil {
+		return
+	}
+	w.state.ResumeToken = token
+	w.saveState(bson.M{"resumeToken": token})
+}
+
+func (w *AdWatcher) saveRevision(revision int64) {
+	w.state.Revision = revision
+	w.saveState(bson.M{"revision": revision})
+}
+
+// saveState stores fields of the state. Failures only cost replaying changes after a restart.
+func (w *AdWatcher) saveState(fields bson.M) {
+	col, err := w.stateCollection()
+	if err == nil {
+		_, err = col.UpdateOne(w.ctx, bson.M{"_id": w.instance}, bson.M{"$set": fields}, options.Update().SetUpsert(true))
+	}
+	if err != nil && w.ctx.Err() == nil {
+		slog.Warn("failed to save watch state", "error", err)
+	}
+}
+
+// sleep waits for d and reports false if the watcher was closed meanwhile.
+func (w *AdWatcher) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-w.ctx.Done():
+		return false
+	}
+}
+
+// Close stops watching.
+func (w *AdWatcher) Close(ctx context.Context) error {
+	w.cancel()
+
+	w.mu.Lock()
+	started := w.started
+	w.mu.Unlock()
+	if !started {
+		return nil
+	}
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isChangeStreamUnsupported reports whether err is the refusal of a change stream by a standalone server.
+func isChangeStreamUnsupported(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && cmdErr.Code == changeStreamUnsupportedCode
+}
+
+// isChangeStreamHistoryLost reports whether err means a change stream cannot resume from its token.
+func isChangeStreamHistoryLost(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && cmdErr.Code == changeStreamHistoryLostCode
+}
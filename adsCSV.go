@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// csvColumns is the column layout of the CSV export and import. Each row holds
+// one condition of an ad, and consecutive rows with the same id, or without id
+// and with the same ref, hold the conditions of the same ad.
+var csvColumns = []string{"id", "ref", "title", "startAt", "endAt", "ageStart", "ageEnd", "gender", "country", "region", "city", "platform"}
+
+// optionalCSVColumns may be missing from an import.
+var optionalCSVColumns = []string{"ref"}
+
+const (
+	// csvListSeparator separates the values of a list cell.
+	csvListSeparator = "|"
+	// csvEmptyList is the cell of an empty list, which matches no value.
+	// An empty cell is a missing list, which matches any value.
+	csvEmptyList = "-"
+	// csvFormulaStarts are the first characters of the cells spreadsheets evaluate as formulas.
+	csvFormulaStarts = "=+-@\t\r"
+)
+
+// ImportChange is a change made to the ads by an import.
+type ImportChange struct {
+	// Row is the first CSV row of the ad, the header being row 1.
+	Row int `json:"row"`
+	// Action is "create" or "update".
+	Action string `json:"action"`
+	// ID is the ID of the ad, once created for new ads.
+	ID string `json:"id,omitempty"`
+	// Ref is the ref cell of the rows of a new ad.
+	Ref string `json:"ref,omitempty"`
+	// Fields lists the fields changed by an update.
+	Fields []string `json:"fields,omitempty"`
+}
+
+// ImportError is an invalid cell or row of an import.
+type ImportError struct {
+	Row     int    `json:"row"`
+	Column  string `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+// ImportReport is the response of an import.
+type ImportReport struct {
+	// DryRun is set when the changes were only computed, not applied.
+	DryRun    bool           `json:"dryRun"`
+	Created   int            `json:"created"`
+	Updated   int            `json:"updated"`
+	Unchanged int            `json:"unchanged"`
+	Changes   []ImportChange `json:"changes"`
+	Errors    []ImportError  `json:"errors,omitempty"`
+}
+
+// details returns the errors of the report, with fields naming their cell,
+// such as rows[5].ageStart.
+func (r ImportReport) details() []FieldError {
+	details := make([]FieldError, len(r.Errors))
+	for i, e := range r.Errors {
+		field := fmt.Sprintf("rows[%d]", e.Row)
+		if e.Column != "" {
+			field += "." + e.Column
+		}
+		details[i] = FieldError{Field: field, Message: e.Message}
+	}
+	return details
+}
+
+// csvAd is an ad read from CSV rows.
+type csvAd struct {
+	ad Advertisement
+	// rows are the rows of the conditions of the ad, or of the ad alone if it has none.
+	rows []int
+	// ref groups the rows of a new ad.
+	ref string
+	// fields holds the id, title, startAt and endAt cells of the first row.
+	fields [4]string
+}
+
+// exportAds responds with every ad as CSV, in the layout of csvColumns.
+func exportAds(c *gin.Context) {
+	ads, err := allAds(c.Request.Context())
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	_ = w.Write(csvColumns)
+	for _, ad := range ads {
+		for _, row := range csvRows(ad) {
+			_ = w.Write(row)
+		}
+	}
+	w.Flush()
+	c.Header("Content-Disposition", `attachment; filename="ads.csv"`)
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+}
+
+// importAds creates and updates ads from a CSV body in the layout of csvColumns.
+// Rows with an id update the ad with this ID, or create it if it does not exist,
+// and rows without create new ads. Unless the dryRun query parameter is false,
+// the changes are only reported. Nothing is written if any row is invalid.
+func importAds(c *gin.Context) {
+	dryRun, err := strconv.ParseBool(c.DefaultQuery("dryRun", "true"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidBody, "dryRun must be true or false")
+		return
+	}
+
+	ads, errs, err := readCSVAds(c.Request.Body, cfg.BulkMaxAds)
+	if errors.Is(err, errTooManyAds) {
+		respondError(c, http.StatusRequestEntityTooLarge, CodeTooManyAds,
+			fmt.Sprintf("at most %d ads can be imported at once", cfg.BulkMaxAds))
+		return
+	} else if err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidBody, "Failed reading CSV: "+err.Error())
+		return
+	}
+
+	ctx := c.Request.Context()
+	existing, err := allAds(ctx)
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+	stored := make(map[primitive.ObjectID]Advertisement, len(existing))
+	for _, ad := range existing {
+		stored[ad.ID] = ad
+	}
+
+	report := ImportReport{DryRun: dryRun, Changes: []ImportChange{}, Errors: errs}
+	var creates, updates []Advertisement
+	var created []int
+	for _, ad := range ads {
+		// Created and changed ads wait for approval
+		ad.ad.Status = AdPending
+		change := ImportChange{Row: ad.rows[0], Action: "create", Ref: ad.ref}
+		if !ad.ad.ID.IsZero() {
+			change.ID = ad.ad.ID.Hex()
+		}
+		if previous, ok := stored[ad.ad.ID]; ok && !ad.ad.ID.IsZero() {
+			change.Action = "update"
+			if change.Fields = changedFields(previous, ad.ad); len(change.Fields) == 0 {
+				report.Unchanged++
+				continue
+			}
+			updates = append(updates, ad.ad)
+			report.Updated++
+		} else {
+			created = append(created, len(report.Changes))
+			creates = append(creates, ad.ad)
+			report.Created++
+		}
+		report.Changes = append(report.Changes, change)
+	}
+
+	if len(report.Errors) > 0 {
+		respondErrorReport(c, http.StatusBadRequest, CodeValidationFailed, "Validation failed", report, report.details()...)
+		return
+	}
+	if dryRun {
+		c.IndentedJSON(http.StatusOK, report)
+		return
+	}
+
+	if len(creates) > 0 {
+		ids, err := adStore.InsertAds(ctx, creates, false)
+		if err != nil {
+			respondImportError(c, err)
+			return
+		}
+		for i, id := range ids {
+			report.Changes[created[i]].ID = id
+		}
+	}
+	for _, ad := range updates {
+		if err := adStore.UpdateAd(ctx, ad.ID.Hex(), ad); err != nil {
+			respondImportError(c, err)
+			return
+		}
+	}
+	if len(report.Changes) > 0 {
+		adCache.Clear()
+	}
+	c.IndentedJSON(http.StatusOK, report)
+}
+
+// respondImportError writes the response for a database error while applying an import.
+// The ads written before the error are kept.
+func respondImportError(c *gin.Context, err error) {
+	adCache.Clear()
+	respondStoreError(c, err)
+}
+
+// allAds returns every ad sorted by ID, that is by creation time.
+func allAds(ctx context.Context) ([]Advertisement, error) {
+	// Every ad ends after the zero time
+	ads, err := adStore.FindLiveAds(ctx, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ads, func(i, j int) bool {
+		return bytes.Compare(ads[i].ID[:], ads[j].ID[:]) < 0
+	})
+	return ads, nil
+}
+
+// changedFields returns the names of the fields of ad differing from previous.
+func changedFields(previous, ad Advertisement) []string {
+	var fields []string
+	if previous.Title != ad.Title {
+		fields = append(fields, "title")
+	}
+	if !storedTime(previous.StartAt).Equal(storedTime(ad.StartAt)) {
+		fields = append(fields, "startAt")
+	}
+	if !storedTime(previous.EndAt).Equal(storedTime(ad.EndAt)) {
+		fields = append(fields, "endAt")
+	}
+	// No conditions match nothing, whether the list is missing or empty
+	noConditions := len(previous.Conditions) == 0 && len(ad.Conditions) == 0
+	if !noConditions && !reflect.DeepEqual(previous.Conditions, ad.Conditions) {
+		fields = append(fields, "conditions")
+	}
+	return fields
+}
+
+// csvRows returns the CSV rows of ad, one per condition.
+func csvRows(ad Advertisement) [][]string {
+	head := []string{ad.ID.Hex(), "", escapeCSVText(ad.Title), formatCSVTime(ad.StartAt), formatCSVTime(ad.EndAt)}
+	if len(ad.Conditions) == 0 {
+		return [][]string{append(head, "", "", "", "", "", "", "")}
+	}
+	rows := make([][]string, len(ad.Conditions))
+	for i, cond := range ad.Conditions {
+		rows[i] = append(slices.Clone(head),
+			strconv.Itoa(cond.AgeStart),
+			strconv.Itoa(cond.AgeEnd),
+			formatCSVList(cond.Gender),
+			formatCSVList(cond.Country),
+			formatCSVList(cond.Region),
+			formatCSVList(cond.City),
+			formatCSVList(cond.Platform),
+		)
+	}
+	return rows
+}
+
+// escapeCSVText prefixes text a spreadsheet would evaluate as a formula with a
+// quote, so it is displayed as text. Text whose quotes are followed by such a
+// formula gets one more quote, so unescapeCSVText always restores the text.
+func escapeCSVText(s string) string {
+	if isCSVFormula(strings.TrimLeft(s, "'")) {
+		return "'" + s
+	}
+	return s
+}
+
+// unescapeCSVText removes the quote added by escapeCSVText.
+func unescapeCSVText(s string) string {
+	if strings.HasPrefix(s, "'") && isCSVFormula(strings.TrimLeft(s, "'")) {
+		return s[1:]
+	}
+	return s
+}
+
+func isCSVFormula(s string) bool {
+	return s != "" && strings.ContainsRune(csvFormulaStarts, rune(s[0]))
+}
+
+func formatCSVTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func formatCSVList[T ~string](list []T) string {
+	if list == nil {
+		return ""
+	} else if len(list) == 0 {
+		return csvEmptyList
+	}
+	values := make([]string, len(list))
+	for i, v := range list {
+		values[i] = string(v)
+	}
+	return strings.Join(values, csvListSeparator)
+}
+
+// readCSVAds reads the ads of CSV rows in the layout of csvColumns, in any column
+// order, and returns the invalid cells and ads. It fails with errTooManyAds after
+// max ads, and when the CSV is malformed or its header does not match the layout.
+func readCSVAds(body io.Reader, max int) ([]csvAd, []ImportError, error) {
+	r := csv.NewReader(body)
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, nil, errors.New("missing header")
+	} else if err != nil {
+		return nil, nil, err
+	}
+	col := map[string]int{}
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if !slices.Contains(csvColumns, name) {
+			return nil, nil, fmt.Errorf("unknown column %s", name)
+		}
+		col[name] = i
+	}
+	for _, name := range csvColumns {
+		if _, ok := col[name]; !ok && !slices.Contains(optionalCSVColumns, name) {
+			return nil, nil, fmt.Errorf("missing column %s", name)
+		}
+	}
+
+	var ads []csvAd
+	var errs []ImportError
+	seen := map[primitive.ObjectID]int{}
+	seenRefs := map[string]int{}
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		row, _ := r.FieldPos(0)
+		cell := func(name string) string {
+			i, ok := col[name]
+			if !ok {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+		fail := func(column, format string, args ...interface{}) {
+			errs = append(errs, ImportError{Row: row, Column: column, Message: fmt.Sprintf(format, args...)})
+		}
+
+		// Rows without id nor ref are ads of their own
+		fields := [4]string{cell("id"), unescapeCSVText(cell("title")), cell("startAt"), cell("endAt")}
+		ref := cell("ref")
+		if fields[0] != "" {
+			ref = ""
+		}
+		var last *csvAd
+		if len(ads) > 0 {
+			last = &ads[len(ads)-1]
+		}
+		if last == nil || (fields[0] == "" && ref == "") || fields[0] != last.fields[0] || ref != last.ref {
+			if len(ads) == max {
+				return nil, nil, errTooManyAds
+			}
+			ad := csvAd{fields: fields, ref: ref, ad: Advertisement{Title: fields[1]}}
+			if fields[0] != "" {
+				id, err := primitive.ObjectIDFromHex(fields[0])
+				if err != nil {
+					fail("id", "must be an ad id")
+				} else if first, ok := seen[id]; ok {
+					fail("id", "is already used by the ad at row %d", first)
+				} else {
+					ad.ad.ID = id
+					seen[id] = row
+				}
+			} else if ref != "" {
+				if first, ok := seenRefs[ref]; ok {
+					fail("ref", "is already used by the ad at row %d", first)
+				} else {
+					seenRefs[ref] = row
+				}
+			}
+			ad.ad.StartAt = parseCSVTime(fields[2], "startAt", fail)
+			ad.ad.EndAt = parseCSVTime(fields[3], "endAt", fail)
+			ads = append(ads, ad)
+		} else {
+			for i, name := range []string{"title", "startAt", "endAt"} {
+				if fields[i+1] != last.fields[i+1] {
+					fail(name, "must be the same as in the first row of the ad, row %d", last.rows[0])
+				}
+			}
+		}
+		ad := &ads[len(ads)-1]
+
+		// A row without condition cells is an ad without conditions
+		if cell("ageStart")+cell("ageEnd")+cell("gender")+cell("country")+cell("region")+cell("city")+cell("platform") == "" {
+			if len(ad.rows) > 0 {
+				fail("", "only the first row of an ad may have no condition")
+			}
+			ad.rows = append(ad.rows, row)
+			continue
+		}
+		if len(ad.rows) > len(ad.ad.Conditions) {
+			fail("", "only the first row of an ad may have no condition")
+		}
+		cond := Condition{
+			AgeStart: parseCSVInt(cell("ageStart"), "ageStart", fail),
+			AgeEnd:   parseCSVInt(cell("ageEnd"), "ageEnd", fail),
+			Gender: parseCSVList(cell("gender"), func(s string) Gender {
+				return Gender(strings.ToUpper(s))
+			}),
+			Country: parseCSVList(cell("country"), ParseCountry),
+			Region:  parseCSVList(cell("region"), ParseRegion),
+			City:    parseCSVList(cell("city"), ParseCity),
+			Platform: parseCSVList(cell("platform"), func(s string) Platform {
+				return Platform(strings.ToLower(s))
+			}),
+		}
+		ad.ad.Conditions = append(ad.ad.Conditions, cond)
+		ad.rows = append(ad.rows, row)
+	}
+
+	// Cells that failed to parse are not reported again by the validation
+	failed := map[ImportError]bool{}
+	for _, e := range errs {
+		failed[ImportError{Row: e.Row, Column: e.Column}] = true
+	}
+	for i := range ads {
+		for _, e := range ValidateAdvertisement(ads[i].ad) {
+			e := csvImportError(ads[i], e)
+			if !failed[ImportError{Row: e.Row, Column: e.Column}] {
+				errs = append(errs, e)
+			}
+		}
+		// Ads are compared with the stored ads, which are normalized
+		normalizeConditions(ads[i].ad.Conditions)
+	}
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Row < errs[j].Row })
+	return ads, errs, nil
+}
+
+// csvImportError locates the validation error e of ad in its rows.
+func csvImportError(ad csvAd, e FieldError) ImportError {
+	row, column := ad.rows[0], e.Field
+	var i int
+	if n, _ := fmt.Sscanf(e.Field, "conditions[%d].", &i); n == 1 && i < len(ad.rows) {
+		row = ad.rows[i]
+		column = e.Field[strings.Index(e.Field, ".")+1:]
+		column, _, _ = strings.Cut(column, "[")
+	}
+	return ImportError{Row: row, Column: column, Message: e.Message}
+}
+
+func parseCSVTime(s, column string, fail func(column, format string, args ...interface{})) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		fail(column, "must be a time such as 2024-01-31T16:00:00.000Z")
+	}
+	return t
+}
+
+func parseCSVInt(s, column string, fail func(column, format string, args ...interface{})) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		fail(column, "must be an integer")
+	}
+	return n
+}
+
+func parseCSVList[T ~string](s string, parse func(string) T) []T {
+	switch s {
+	case "":
+		return nil
+	case csvEmptyList:
+		return []T{}
+	}
+	values := strings.Split(s, csvListSeparator)
+	list := make([]T, len(values))
+	for i, v := range values {
+		list[i] = parse(strings.TrimSpace(v))
+	}
+	return list
+}
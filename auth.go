@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// APIKey is a stored API key. The key itself is only returned once, when created.
+// A key without roles can only use the public ad search.
+type APIKey struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name      string             `json:"name" bson:"name"`
+	Roles     []Role             `json:"roles" bson:"roles"`
+	Prefix    string             `json:"prefix" bson:"prefix"`
+	Hash      string             `json:"-" bson:"hash"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+	RevokedAt *time.Time         `json:"revokedAt,omitempty" bson:"revokedAt,omitempty"`
+}
+
+// apiKeyPrefix starts every generated key so they are easy to recognize.
+const apiKeyPrefix = "ak_"
+
+// apiKeyKey is the gin context key of the authenticated APIKey.
+const apiKeyKey = "apiKey"
+
+// generateAPIKey returns a new random key.
+func generateAPIKey() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashAPIKey returns the hash under which a key is stored.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestAPIKey extracts the key from the X-API-Key header or a bearer Authorization header.
+func requestAPIKey(c *gin.Context) string {
+	if key := c.GetHeader("X-API-Key"); key != "" {
+		return key
+	}
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// authenticate returns the API key matching the request credentials.
+// The configured bootstrap admin key is accepted without being stored.
+func authenticate(c *gin.Context) (APIKey, error) {
+	key := requestAPIKey(c)
+	if key == "" {
+		return APIKey{}, ErrKeyNotFound
+	}
+	hash := hashAPIKey(key)
+	if cfg.AdminAPIKey != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(hashAPIKey(cfg.AdminAPIKey))) == 1 {
+		return APIKey{Name: "bootstrap", Roles: []Role{RoleAdmin}}, nil
+	}
+	stored, err := keyStore.FindKeyByHash(c.Request.Context(), hash)
+	if err != nil {
+		return APIKey{}, err
+	}
+	if stored.RevokedAt != nil {
+		return APIKey{}, ErrKeyNotFound
+	}
+	return stored, nil
+}
+
+// requireAPIKey rejects requests without a valid API key.
+// Permissions of the key are checked by requirePermission.
+func requireAPIKey(c *gin.Context) {
+	key, err := authenticate(c)
+	if errors.Is(err, ErrKeyNotFound) {
+		c.Header("WWW-Authenticate", `Bearer realm="api"`)
+		respondError(c, http.StatusUnauthorized, CodeUnauthorized, "missing or invalid API key")
+		return
+	} else if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+	c.Set(apiKeyKey, key)
+	c.Next()
+}
+
+// publicAccess guards the public endpoint: open by default, or requiring
+// any valid key when RequirePublicKey is set. A key sent to the open endpoint
+// must still be valid, and the request is then also rate limited by key.
+func publicAccess(c *gin.Context) {
+	if !cfg.RequirePublicKey && requestAPIKey(c) == "" {
+		c.Next()
+		return
+	}
+	requireAPIKey(c)
+}
+
+// createKeyRequest is the body of POST /api/v1/keys.
+type createKeyRequest struct {
+	Name  string `json:"name"`
+	Roles []Role `json:"roles"`
+}
+
+// createdKey is the response of POST /api/v1/keys, the only one containing the key.
+type createdKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// createKey generates and stores a new API key.
+func createKey(c *gin.Context) {
+	var req createKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+	var errs ValidationErrors
+	if req.Name == "" {
+		errs.add("name", "is required")
+	}
+	for i, role := range req.Roles {
+		if !role.IsValid() {
+			errs.add(fmt.Sprintf("roles[%d]", i), "must be one of %s, %s, %s, %s", RoleViewer, RoleEditor, RoleApprover, RoleAdmin)
+		}
+	}
+	if len(errs) > 0 {
+		respondError(c, http.StatusBadRequest, CodeValidationFailed, "Validation failed", errs...)
+		return
+	}
+
+	plain := generateAPIKey()
+	key := APIKey{
+		Name:      req.Name,
+		Roles:     append([]Role{}, req.Roles...),
+		Prefix:    plain[:len(apiKeyPrefix)+6],
+		Hash:      hashAPIKey(plain),
+		CreatedAt: time.Now().UTC().Truncate(time.Millisecond),
+	}
+	id, err := keyStore.CreateKey(c.Request.Context(), key)
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+	key.ID, _ = primitive.ObjectIDFromHex(id)
+	c.IndentedJSON(http.StatusCreated, createdKey{APIKey: key, Key: plain})
+}
+
+// listKeys responds with every API key, without the keys themselves.
+func listKeys(c *gin.Context) {
+	keys, err := keyStore.ListKeys(c.Request.Context())
+	if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+	c.IndentedJSON(http.StatusOK, gin.H{"items": keys})
+}
+
+// revokeKey revokes the API key whose ID is given in the path.
+func revokeKey(c *gin.Context) {
+	err := keyStore.RevokeKey(c.Request.Context(), c.Param("id"), time.Now().UTC())
+	if errors.Is(err, ErrKeyNotFound) {
+		respondError(c, http.StatusNotFound, CodeKeyNotFound, "api key not found")
+		return
+	} else if errors.Is(err, ErrInvalidID) {
+		respondError(c, http.StatusBadRequest, CodeInvalidID, "invalid api key id")
+		return
+	} else if err != nil {
+		respondStoreError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
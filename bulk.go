@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// errTooManyAds is returned when a bulk request holds more than cfg.BulkMaxAds ads.
+var errTooManyAds = errors.New("too many ads")
+
+// BulkResult is the outcome of one ad of a bulk request.
+type BulkResult struct {
+	// Line is the line of the ad in a JSONL body, or its position from 1 in a JSON array.
+	Line int `json:"line"`
+	// ID is the ID of the created ad.
+	ID string `json:"id,omitempty"`
+	// Error explains why the ad was not created.
+	Error  string       `json:"error,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// BulkReport is the response of a bulk request, with one result per ad in request order.
+type BulkReport struct {
+	Created int          `json:"created"`
+	Failed  int          `json:"failed"`
+	Results []BulkResult `json:"results"`
+}
+
+// details returns the errors of the report, with fields prefixed by the line
+// of their ad, such as lines[2].title.
+func (r BulkReport) details() []FieldError {
+	var details []FieldError
+	for _, result := range r.Results {
+		prefix := fmt.Sprintf("lines[%d]", result.Line)
+		if len(result.Errors) == 0 && result.Error != "" {
+			details = append(details, FieldError{Field: prefix, Message: result.Error})
+		}
+		for _, e := range result.Errors {
+			details = append(details, FieldError{Field: prefix + "." + e.Field, Message: e.Message})
+		}
+	}
+	return details
+}
+
+// bulkItem is an undecoded ad of a bulk request.
+type bulkItem struct {
+	line int
+	raw  []byte
+}
+
+// adsActions returns the handler of the custom methods of the ads collection, such
+// as POST /api/v1/ads:bulk, running middleware then the handlers of the method named
+// in the path. The method is resolved first, so unknown paths are not found
+// without going through authentication.
+func adsActions(middleware gin.HandlersChain, actions map[string]gin.HandlersChain) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// The path parameter also matches paths such as /api/v1/adsbulk
+		name, found := strings.CutPrefix(c.Param("action"), ":")
+		handlers, ok := actions[name]
+		if !found || !ok {
+			notFound(c)
+			return
+		}
+		for _, handler := range slices.Concat(middleware, handlers) {
+			if handler(c); c.IsAborted() {
+				return
+			}
+		}
+	}
+}
+
+// bulkAds creates the ads of a JSON array or of a JSONL body, one ad per line.
+// Every ad is validated independently and the valid ones are created, unless
+// the atomic query parameter is true: then either every ad is created or none is.
+func bulkAds(c *gin.Context) {
+	atomic, err := strconv.ParseBool(c.DefaultQuery("atomic", "false"))
+	if err != nil {
+		respondError(c, http.StatusBadRequest, CodeInvalidBody, "atomic must be true or false")
+		return
+	}
+
+	items, err := readBulkItems(c.Request.Body, cfg.BulkMaxAds)
+	if errors.Is(err, errTooManyAds) {
+		respondError(c, http.StatusRequestEntityTooLarge, CodeTooManyAds,
+			fmt.Sprintf("at most %d ads can be created at once", cfg.BulkMaxAds))
+		return
+	} else if err != nil {
+		respondBindingError(c, err)
+		return
+	} else if len(items) == 0 {
+		respondError(c, http.StatusBadRequest, CodeInvalidBody, "no ads in request body")
+		return
+	}
+
+	report := BulkReport{Results: make([]BulkResult, len(items))}
+	var ads []Advertisement
+	var valid []int
+	for i, item := range items {
+		result := &report.Results[i]
+		result.Line = item.line
+
+		var ad Advertisement
+		if err := json.Unmarshal(item.raw, &ad); err != nil {
+			result.Error = "Failed binding data"
+			result.Errors = bindingErrorDetails(err)
+			continue
+		} else if errs := ValidateAdvertisement(ad); len(errs) > 0 {
+			result.Error = "Validation failed"
+			result.Errors = errs
+			continue
+		}
+		// The ID is always assigned by the store, and new ads wait for approval
+		ad.ID = primitive.NilObjectID
+		ad.Status = AdPending
+		normalizeConditions(ad.Conditions)
+		ads = append(ads, ad)
+		valid = append(valid, i)
+	}
+
+	if atomic && len(valid) < len(items) {
+		report.Failed = len(items) - len(valid)
+		respondErrorReport(c, http.StatusBadRequest, CodeValidationFailed, "Validation failed", report, report.details()...)
+		return
+	}
+
+	var ids []string
+	if len(ads) > 0 {
+		ids, err = adStore.InsertAds(c.Request.Context(), ads, atomic)
+	}
+	for i, id := range ids {
+		if id != "" {
+			report.Results[valid[i]].ID = id
+			report.Created++
+		}
+	}
+	if report.Created > 0 {
+		adCache.Clear()
+	}
+	if err != nil && report.Created == 0 {
+		respondStoreError(c, err)
+		return
+	} else if err != nil {
+		requestLog(c).Error("failed to create some ads", "error", err)
+	}
+
+	for i := range report.Results {
+		result := &report.Results[i]
+		if result.ID == "" && result.Error == "" {
+			result.Error = "Failed adding data to database"
+		}
+	}
+	report.Failed = len(items) - report.Created
+
+	status := http.StatusCreated
+	if report.Failed > 0 {
+		status = http.StatusMultiStatus
+	}
+	c.IndentedJSON(status, report)
+}
+
+// readBulkItems splits body into ads, read from a JSON array if it starts with '['
+// and from one JSON value per non-blank line otherwise. It fails with errTooManyAds
+// after max ads, and on syntax errors of an array; a line that is not valid JSON
+// is reported with its ad instead.
+func readBulkItems(body io.Reader, max int) ([]bulkItem, error) {
+	r := bufio.NewReader(body)
+	var items []bulkItem
+	first, skipped, err := peekNonSpace(r)
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if first == '[' {
+		dec := json.NewDecoder(r)
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		for dec.More() {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return nil, err
+			}
+			if len(items) == max {
+				return nil, errTooManyAds
+			}
+			items = append(items, bulkItem{line: len(items) + 1, raw: raw})
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return items, nil
+	}
+
+	for line := skipped + 1; ; line++ {
+		raw, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if raw = bytes.TrimSpace(raw); len(raw) > 0 {
+			if len(items) == max {
+				return nil, errTooManyAds
+			}
+			items = append(items, bulkItem{line: line, raw: raw})
+		}
+		if err == io.EOF {
+			return items, nil
+		}
+	}
+}
+
+// peekNonSpace skips the leading white space of r and returns the next byte without
+// consuming it, and the number of lines skipped.
+func peekNonSpace(r *bufio.Reader) (byte, int, error) {
+	lines := 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, lines, err
+		}
+		switch b {
+		case '\n':
+			lines++
+		case ' ', '\t', '\r':
+		default:
+			return b, lines, r.UnreadByte()
+		}
+	}
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Duration is a time.Duration read from configuration files as a string such as "10s".
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	return d.Set(value.Value)
+}
+
+// Config holds the settings of the server.
+type Config struct {
+	// ListenAddr is the address the HTTP server binds to.
+	ListenAddr string `json:"listenAddr" yaml:"listenAddr"`
+	// Store selects the AdStore implementation: "mongo" or "memory".
+	Store string `json:"store" yaml:"store"`
+	// MongoURI is the connection string of the MongoDB deployment.
+	MongoURI string `json:"mongoURI" yaml:"mongoURI"`
+	// DBName is the name of the database holding the ads collection.
+	DBName string `json:"dbName" yaml:"dbName"`
+	// CollectionName is the name of the ads collection.
+	CollectionName string `json:"collectionName" yaml:"collectionName"`
+	// MaxPoolSize is the maximum number of connections to MongoDB.
+	MaxPoolSize uint64 `json:"maxPoolSize" yaml:"maxPoolSize"`
+	// ConnectTimeout bounds the time to establish a MongoDB connection.
+	ConnectTimeout Duration `json:"connectTimeout" yaml:"connectTimeout"`
+	// ReconnectMinBackoff is the delay before the first reconnection attempt.
+	ReconnectMinBackoff Duration `json:"reconnectMinBackoff" yaml:"reconnectMinBackoff"`
+	// ReconnectMaxBackoff caps the delay between reconnection attempts.
+	ReconnectMaxBackoff Duration `json:"reconnectMaxBackoff" yaml:"reconnectMaxBackoff"`
+	// PingInterval is the time between two checks of the MongoDB connection.
+	PingInterval Duration `json:"pingInterval" yaml:"pingInterval"`
+	// ReadTimeout bounds the time to read a request, including its body.
+	ReadTimeout Duration `json:"readTimeout" yaml:"readTimeout"`
+	// WriteTimeout bounds the time from the end of the request headers to the end of the response.
+	WriteTimeout Duration `json:"writeTimeout" yaml:"writeTimeout"`
+	// IdleTimeout bounds the time a keep-alive connection waits for the next request.
+	IdleTimeout Duration `json:"idleTimeout" yaml:"idleTimeout"`
+	// KeyCollectionName is the name of the API keys collection.
+	KeyCollectionName string `json:"keyCollectionName" yaml:"keyCollectionName"`
+	// AdminAPIKey is an admin key accepted without being stored, used to create the first keys.
+	AdminAPIKey string `json:"adminAPIKey" yaml:"adminAPIKey"`
+	// RequirePublicKey requires an API key on the public ad search.
+	RequirePublicKey bool `json:"requirePublicKey" yaml:"requirePublicKey"`
+	// RequestTimeout bounds the time to handle a request, including database calls. Zero disables it.
+	RequestTimeout Duration `json:"requestTimeout" yaml:"requestTimeout"`
+	// ServingIndexRefresh is the time between two rebuilds of the in-process index
+	// answering the public search. Zero sends every search to the database.
+	ServingIndexRefresh Duration `json:"servingIndexRefresh" yaml:"servingIndexRefresh"`
+	// ResponseCacheTTL bounds the time a public search response is cached when no
+	// matching ad starts or ends sooner. Zero disables the cache.
+	ResponseCacheTTL Duration `json:"responseCacheTTL" yaml:"responseCacheTTL"`
+	// ResponseCacheSize is the maximum number of cached public search responses.
+	ResponseCacheSize int `json:"responseCacheSize" yaml:"responseCacheSize"`
+	// BulkMaxAds is the maximum number of ads in a bulk request.
+	BulkMaxAds int `json:"bulkMaxAds" yaml:"bulkMaxAds"`
+	// BulkBatchSize is the number of ads inserted by each database call of a bulk request.
+	BulkBatchSize int `json:"bulkBatchSize" yaml:"bulkBatchSize"`
+	// WatchMode selects how changes made by other instances are followed: "auto" uses
+	// change streams when supported and polls otherwise, "changestream", "poll" or "off".
+	WatchMode string `json:"watchMode" yaml:"watchMode"`
+	// WatchPollInterval is the time between two checks for changed ads when polling.
+	WatchPollInterval Duration `json:"watchPollInterval" yaml:"watchPollInterval"`
+	// WatchStateCollectionName is the name of the collection saving the progress of each instance.
+	WatchStateCollectionName string `json:"watchStateCollectionName" yaml:"watchStateCollectionName"`
+	// ShutdownTimeout bounds the time to drain in-flight requests and release resources on shutdown.
+	ShutdownTimeout Duration `json:"shutdownTimeout" yaml:"shutdownTimeout"`
+	// RateLimits maps routes such as "GET /api/v1/ad" to the limit of each client.
+	// A route with a zero burst is not limited.
+	RateLimits map[string]RateLimit `json:"rateLimits" yaml:"rateLimits"`
+	// RateLimitStore selects where buckets are kept: "memory" per instance, or "mongo" shared.
+	RateLimitStore string `json:"rateLimitStore" yaml:"rateLimitStore"`
+	// RateLimitCollectionName is the name of the collection of shared buckets.
+	RateLimitCollectionName string `json:"rateLimitCollectionName" yaml:"rateLimitCollectionName"`
+	// LogLevel is the minimum level of logged messages: "debug", "info", "warn" or "error".
+	LogLevel string `json:"logLevel" yaml:"logLevel"`
+	// TrustedProxies lists the proxies whose X-Forwarded-For header gives the client IP.
+	TrustedProxies []string `json:"trustedProxies" yaml:"trustedProxies"`
+	// GeoIPDatabase is the path of a MaxMind database locating client IPs
+	// for searches without a location; empty to disable the lookup.
+	GeoIPDatabase string `json:"geoipDatabase" yaml:"geoipDatabase"`
+}
+
+// publicAdRoute is the route of the public ad search in RateLimits.
+const publicAdRoute = "GET /api/v1/ad"
+
+// cfg is the configuration of the running server.
+var cfg = DefaultConfig()
+
+// DefaultConfig returns the configuration used when nothing else is set.
+func DefaultConfig() Config {
+	return Config{
+		ListenAddr:          "localhost:8080",
+		Store:               "mongo",
+		MongoURI:            "mongodb://localhost:27017",
+		DBName:              "development_api",
+		CollectionName:      "ads",
+		KeyCollectionName:   "api_keys",
+		MaxPoolSize:         100,
+		ConnectTimeout:      Duration(10 * time.Second),
+		ReconnectMinBackoff: Duration(500 * time.Millisecond),
+		ReconnectMaxBackoff: Duration(30 * time.Second),
+		PingInterval:        Duration(5 * time.Second),
+		ReadTimeout:         Duration(10 * time.Second),
+		WriteTimeout:        Duration(30 * time.Second),
+		IdleTimeout:         Duration(60 * time.Second),
+		RequestTimeout:      Duration(5 * time.Second),
+		ServingIndexRefresh: Duration(30 * time.Second),
+		ResponseCacheTTL:    Duration(time.Minute),
+		ResponseCacheSize:   10000,
+		BulkMaxAds:          1000,
+		BulkBatchSize:       100,
+		ShutdownTimeout:     Duration(15 * time.Second),
+		RateLimits: map[string]RateLimit{
+			publicAdRoute: {Rate: 10, Burst: 20},
+		},
+		RateLimitStore:           "memory",
+		RateLimitCollectionName:  "rate_limits",
+		WatchMode:                watchAuto,
+		WatchPollInterval:        Duration(2 * time.Second),
+		WatchStateCollectionName: "watch_state",
+		LogLevel:                 "info",
+	}
+}
+
+// configEnv maps environment variables to the settings they override.
+var configEnv = map[string]func(c *Config, v string) error{
+	"LISTEN_ADDR":         func(c *Config, v string) error { c.ListenAddr = v; return nil },
+	"AD_STORE":            func(c *Config, v string) error { c.Store = v; return nil },
+	"MONGO_URI":           func(c *Config, v string) error { c.MongoURI = v; return nil },
+	"DB_NAME":             func(c *Config, v string) error { c.DBName = v; return nil },
+	"COLLECTION_NAME":     func(c *Config, v string) error { c.CollectionName = v; return nil },
+	"KEY_COLLECTION_NAME": func(c *Config, v string) error { c.KeyCollectionName = v; return nil },
+	"ADMIN_API_KEY":       func(c *Config, v string) error { c.AdminAPIKey = v; return nil },
+	"REQUIRE_PUBLIC_KEY": func(c *Config, v string) (err error) {
+		c.RequirePublicKey, err = strconv.ParseBool(v)
+		return err
+	},
+	"MONGO_MAX_POOL_SIZE": func(c *Config, v string) (err error) {
+		c.MaxPoolSize, err = strconv.ParseUint(v, 10, 64)
+		return err
+	},
+	"MONGO_CONNECT_TIMEOUT":       func(c *Config, v string) error { return c.ConnectTimeout.Set(v) },
+	"MONGO_RECONNECT_MIN_BACKOFF": func(c *Config, v string) error { return c.ReconnectMinBackoff.Set(v) },
+	"MONGO_RECONNECT_MAX_BACKOFF": func(c *Config, v string) error { return c.ReconnectMaxBackoff.Set(v) },
+	"MONGO_PING_INTERVAL":         func(c *Config, v string) error { return c.PingInterval.Set(v) },
+	"HTTP_READ_TIMEOUT":           func(c *Config, v string) error { return c.ReadTimeout.Set(v) },
+	"HTTP_WRITE_TIMEOUT":          func(c *Config, v string) error { return c.WriteTimeout.Set(v) },
+	"HTTP_IDLE_TIMEOUT":           func(c *Config, v string) error { return c.IdleTimeout.Set(v) },
+	"REQUEST_TIMEOUT":             func(c *Config, v string) error { return c.RequestTimeout.Set(v) },
+	"SERVING_INDEX_REFRESH":       func(c *Config, v string) error { return c.ServingIndexRefresh.Set(v) },
+	"RESPONSE_CACHE_TTL":          func(c *Config, v string) error { return c.ResponseCacheTTL.Set(v) },
+	"SHUTDOWN_TIMEOUT":            func(c *Config, v string) error { return c.ShutdownTimeout.Set(v) },
+	"RATE_LIMIT_STORE":            func(c *Config, v string) error { c.RateLimitStore = v; return nil },
+	"RATE_LIMIT_COLLECTION_NAME":  func(c *Config, v string) error { c.RateLimitCollectionName = v; return nil },
+	"WATCH_MODE":                  func(c *Config, v string) error { c.WatchMode = v; return nil },
+	"WATCH_POLL_INTERVAL":         func(c *Config, v string) error { return c.WatchPollInterval.Set(v) },
+	"WATCH_STATE_COLLECTION_NAME": func(c *Config, v string) error { c.WatchStateCollectionName = v; return nil },
+	"PUBLIC_RATE_LIMIT_RATE": func(c *Config, v string) error {
+		rate, err := strconv.ParseFloat(v, 64)
+		c.setRateLimit(publicAdRoute, func(l *RateLimit) { l.Rate = rate })
+		return err
+	},
+	"PUBLIC_RATE_LIMIT_BURST": func(c *Config, v string) error {
+		burst, err := strconv.Atoi(v)
+		c.setRateLimit(publicAdRoute, func(l *RateLimit) { l.Burst = burst })
+		return err
+	},
+	"RESPONSE_CACHE_SIZE": func(c *Config, v string) (err error) {
+		c.ResponseCacheSize, err = strconv.Atoi(v)
+		return err
+	},
+	"BULK_MAX_ADS": func(c *Config, v string) (err error) {
+		c.BulkMaxAds, err = strconv.Atoi(v)
+		return err
+	},
+	"BULK_BATCH_SIZE": func(c *Config, v string) (err error) {
+		c.BulkBatchSize, err = strconv.Atoi(v)
+		return err
+	},
+	"LOG_LEVEL": func(c *Config, v string) error { c.LogLevel = v; return nil },
+	"TRUSTED_PROXIES": func(c *Config, v string) error {
+		c.TrustedProxies = splitList(v)
+		return nil
+	},
+	"GEOIP_DATABASE": func(c *Config, v string) error { c.GeoIPDatabase = v; return nil },
+}
+
+// setRateLimit changes the limit of a route, copying the map so defaults are not shared.
+func (c *Config) setRateLimit(route string, set func(l *RateLimit)) {
+	limits := make(map[string]RateLimit, len(c.RateLimits)+1)
+	for r, l := range c.RateLimits {
+		limits[r] = l
+	}
+	l := limits[route]
+	set(&l)
+	limits[route] = l
+	c.RateLimits = limits
+}
+
+// splitList splits a comma-separated list, dropping empty items.
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// LoadConfig builds the configuration from the defaults, an optional YAML or JSON file,
+// environment variables and command line flags, each overriding the previous ones.
+// It returns the configuration and the arguments remaining after the flags.
+func LoadConfig(args []string) (Config, []string, error) {
+	c := DefaultConfig()
+
+	// Flags are parsed into a separate value so they can be applied last
+	flagged := c
+	fs := flag.NewFlagSet("api_assignment", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or JSON configuration file")
+	fs.StringVar(&flagged.ListenAddr, "listen", c.ListenAddr, "address the HTTP server binds to")
+	fs.StringVar(&flagged.Store, "store", c.Store, `ad store: "mongo" or "memory"`)
+	fs.StringVar(&flagged.MongoURI, "mongo-uri", c.MongoURI, "MongoDB connection string")
+	fs.StringVar(&flagged.DBName, "db-name", c.DBName, "MongoDB database name")
+	fs.StringVar(&flagged.CollectionName, "collection-name", c.CollectionName, "MongoDB collection name")
+	fs.StringVar(&flagged.KeyCollectionName, "key-collection-name", c.KeyCollectionName, "MongoDB collection name of the API keys")
+	fs.BoolVar(&flagged.RequirePublicKey, "require-public-key", c.RequirePublicKey, "require an API key on the public ad search")
+	fs.Uint64Var(&flagged.MaxPoolSize, "mongo-max-pool-size", c.MaxPoolSize, "maximum number of MongoDB connections")
+	fs.Var(&flagged.ConnectTimeout, "mongo-connect-timeout", "MongoDB connection timeout")
+	fs.Var(&flagged.ReconnectMinBackoff, "mongo-reconnect-min-backoff", "delay before the first MongoDB reconnection attempt")
+	fs.Var(&flagged.ReconnectMaxBackoff, "mongo-reconnect-max-backoff", "maximum delay between MongoDB reconnection attempts")
+	fs.Var(&flagged.PingInterval, "mongo-ping-interval", "time between two MongoDB connection checks")
+	fs.Var(&flagged.ReadTimeout, "http-read-timeout", "maximum time to read a request")
+	fs.Var(&flagged.WriteTimeout, "http-write-timeout", "maximum time to write a response")
+	fs.Var(&flagged.IdleTimeout, "http-idle-timeout", "maximum time to wait for the next request on a keep-alive connection")
+	fs.Var(&flagged.RequestTimeout, "request-timeout", "maximum time to handle a request, 0 for none")
+	fs.Var(&flagged.ServingIndexRefresh, "serving-index-refresh", "time between two rebuilds of the public search index, 0 to query the database")
+	fs.Var(&flagged.ResponseCacheTTL, "response-cache-ttl", "maximum time a public search response is cached, 0 to disable the cache")
+	fs.IntVar(&flagged.ResponseCacheSize, "response-cache-size", c.ResponseCacheSize, "maximum number of cached public search responses")
+	fs.IntVar(&flagged.BulkMaxAds, "bulk-max-ads", c.BulkMaxAds, "maximum number of ads in a bulk request")
+	fs.IntVar(&flagged.BulkBatchSize, "bulk-batch-size", c.BulkBatchSize, "number of ads inserted by each database call of a bulk request")
+	fs.Var(&flagged.ShutdownTimeout, "shutdown-timeout", "maximum time to drain in-flight requests on shutdown")
+	fs.StringVar(&flagged.RateLimitStore, "rate-limit-store", c.RateLimitStore, `rate limit state: "memory" or "mongo"`)
+	fs.StringVar(&flagged.RateLimitCollectionName, "rate-limit-collection-name", c.RateLimitCollectionName, "MongoDB collection name of the rate limit buckets")
+	publicRate := fs.Float64("public-rate-limit-rate", c.RateLimits[publicAdRoute].Rate, "requests per second allowed to each client of the public ad search")
+	publicBurst := fs.Int("public-rate-limit-burst", c.RateLimits[publicAdRoute].Burst, "requests a client of the public ad search can make at once")
+	fs.StringVar(&flagged.WatchMode, "watch-mode", c.WatchMode, `following changes of other instances: "auto", "changestream", "poll" or "off"`)
+	fs.Var(&flagged.WatchPollInterval, "watch-poll-interval", "time between two checks for changed ads when polling")
+	fs.StringVar(&flagged.WatchStateCollectionName, "watch-state-collection-name", c.WatchStateCollectionName, "MongoDB collection name of the saved watch progress")
+	fs.StringVar(&flagged.LogLevel, "log-level", c.LogLevel, `minimum log level: "debug", "info", "warn" or "error"`)
+	fs.StringVar(&flagged.GeoIPDatabase, "geoip-database", c.GeoIPDatabase, "path of a MaxMind database locating client IPs, empty to disable")
+	trustedProxies := fs.String("trusted-proxies", "", "comma-separated proxies whose X-Forwarded-For header is trusted")
+	if err := fs.Parse(args); err != nil {
+		return c, nil, err
+	}
+
+	if *configFile != "" {
+		if err := c.loadFile(*configFile); err != nil {
+			return c, nil, err
+		}
+	}
+
+	for name, apply := range configEnv {
+		if v, ok := os.LookupEnv(name); ok {
+			if err := apply(&c, v); err != nil {
+				return c, nil, fmt.Errorf("invalid %s: %w", name, err)
+			}
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			c.ListenAddr = flagged.ListenAddr
+		case "store":
+			c.Store = flagged.Store
+		case "mongo-uri":
+			c.MongoURI = flagged.MongoURI
+		case "db-name":
+			c.DBName = flagged.DBName
+		case "collection-name":
+			c.CollectionName = flagged.CollectionName
+		case "key-collection-name":
+			c.KeyCollectionName = flagged.KeyCollectionName
+		case "require-public-key":
+			c.RequirePublicKey = flagged.RequirePublicKey
+		case "mongo-max-pool-size":
+			c.MaxPoolSize = flagged.MaxPoolSize
+		case "mongo-connect-timeout":
+			c.ConnectTimeout = flagged.ConnectTimeout
+		case "mongo-reconnect-min-backoff":
+			c.ReconnectMinBackoff = flagged.ReconnectMinBackoff
+		case "mongo-reconnect-max-backoff":
+			c.ReconnectMaxBackoff = flagged.ReconnectMaxBackoff
+		case "mongo-ping-interval":
+			c.PingInterval = flagged.PingInterval
+		case "http-read-timeout":
+			c.ReadTimeout = flagged.ReadTimeout
+		case "http-write-timeout":
+			c.WriteTimeout = flagged.WriteTimeout
+		case "http-idle-timeout":
+			c.IdleTimeout = flagged.IdleTimeout
+		case "request-timeout":
+			c.RequestTimeout = flagged.RequestTimeout
+		case "serving-index-refresh":
+			c.ServingIndexRefresh = flagged.ServingIndexRefresh
+		case "response-cache-ttl":
+			c.ResponseCacheTTL = flagged.ResponseCacheTTL
+		case "response-cache-size":
+			c.ResponseCacheSize = flagged.ResponseCacheSize
+		case "bulk-max-ads":
+			c.BulkMaxAds = flagged.BulkMaxAds
+		case "bulk-batch-size":
+			c.BulkBatchSize = flagged.BulkBatchSize
+		case "shutdown-timeout":
+			c.ShutdownTimeout = flagged.ShutdownTimeout
+		case "rate-limit-store":
+			c.RateLimitStore = flagged.RateLimitStore
+		case "rate-limit-collection-name":
+			c.RateLimitCollectionName = flagged.RateLimitCollectionName
+		case "public-rate-limit-rate":
+			c.setRateLimit(publicAdRoute, func(l *RateLimit) { l.Rate = *publicRate })
+		case "public-rate-limit-burst":
+			c.setRateLimit(publicAdRoute, func(l *RateLimit) { l.Burst = *publicBurst })
+		case "watch-mode":
+			c.WatchMode = flagged.WatchMode
+		case "watch-poll-interval":
+			c.WatchPollInterval = flagged.WatchPollInterval
+		case "watch-state-collection-name":
+			c.WatchStateCollectionName = flagged.WatchStateCollectionName
+		case "log-level":
+			c.LogLevel = flagged.LogLevel
+		case "geoip-database":
+			c.GeoIPDatabase = flagged.GeoIPDatabase
+		case "trusted-proxies":
+			c.TrustedProxies = splitList(*trustedProxies)
+		}
+	})
+
+	return c, fs.Args(), c.Validate()
+}
+
+// loadFile overrides the settings present in a YAML or JSON file.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	if filepath.Ext(path) == ".json" {
+		err = json.Unmarshal(data, c)
+	} else {
+		err = yaml.Unmarshal(data, c)
+	}
+	if err != nil {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate reports every invalid setting.
+func (c Config) Validate() error {
+	var errs []error
+	if c.ListenAddr == "" {
+		errs = append(errs, errors.New("listenAddr must be set"))
+	}
+	if c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.IdleTimeout < 0 {
+		errs = append(errs, errors.New("HTTP timeouts must not be negative"))
+	}
+	if c.RequestTimeout < 0 {
+		errs = append(errs, errors.New("requestTimeout must not be negative"))
+	}
+	if c.ServingIndexRefresh < 0 {
+		errs = append(errs, errors.New("servingIndexRefresh must not be negative"))
+	}
+	if c.ResponseCacheTTL < 0 {
+		errs = append(errs, errors.New("responseCacheTTL must not be negative"))
+	}
+	if c.ResponseCacheTTL > 0 && c.ResponseCacheSize <= 0 {
+		errs = append(errs, errors.New("responseCacheSize must be positive"))
+	}
+	if c.BulkMaxAds <= 0 || c.BulkBatchSize <= 0 {
+		errs = append(errs, errors.New("bulkMaxAds and bulkBatchSize must be positive"))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdownTimeout must be positive"))
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("logLevel must be debug, info, warn or error, got %q", c.LogLevel))
+	}
+	for _, proxy := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			errs = append(errs, fmt.Errorf("trustedProxies %q must be an IP address or CIDR", proxy))
+		}
+	}
+	for route, limit := range c.RateLimits {
+		if method, path, ok := strings.Cut(route, " "); !ok || method == "" || !strings.HasPrefix(path, "/") {
+			errs = append(errs, fmt.Errorf("rateLimits route %q must be a method and a path", route))
+		}
+		if limit.Burst < 0 || (limit.Burst > 0 && limit.Rate <= 0) {
+			errs = append(errs, fmt.Errorf("rateLimits %q must have a positive rate and burst", route))
+		}
+	}
+	switch c.RateLimitStore {
+	case "memory":
+	case "mongo":
+		if c.Store != "mongo" {
+			errs = append(errs, errors.New("rateLimitStore \"mongo\" requires the mongo store"))
+		}
+		if c.RateLimitCollectionName == "" {
+			errs = append(errs, errors.New("rateLimitCollectionName must be set"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("rateLimitStore must be \"memory\" or \"mongo\", got %q", c.RateLimitStore))
+	}
+	switch c.Store {
+	case "mongo":
+		if c.MongoURI == "" {
+			errs = append(errs, errors.New("mongoURI must be set"))
+		}
+		if c.DBName == "" {
+			errs = append(errs, errors.New("dbName must be set"))
+		}
+		if c.CollectionName == "" {
+			errs = append(errs, errors.New("collectionName must be set"))
+		}
+		if c.KeyCollectionName == "" {
+			errs = append(errs, errors.New("keyCollectionName must be set"))
+		}
+		if c.MaxPoolSize == 0 {
+			errs = append(errs, errors.New("maxPoolSize must be positive"))
+		}
+		if c.ConnectTimeout <= 0 {
+			errs = append(errs, errors.New("connectTimeout must be positive"))
+		}
+		if c.ReconnectMinBackoff <= 0 {
+			errs = append(errs, errors.New("reconnectMinBackoff must be positive"))
+		}
+		if c.ReconnectMaxBackoff < c.ReconnectMinBackoff {
+			errs = append(errs, errors.New("reconnectMaxBackoff must not be less than reconnectMinBackoff"))
+		}
+		if c.PingInterval <= 0 {
+			errs = append(errs, errors.New("pingInterval must be positive"))
+		}
+		switch c.WatchMode {
+		case watchAuto, watchPoll:
+			if c.WatchPollInterval <= 0 {
+				errs = append(errs, errors.New("watchPollInterval must be positive"))
+			}
+		case watchChangeStream, watchOff:
+		default:
+			errs = append(errs, fmt.Errorf("watchMode must be \"auto\", \"changestream\", \"poll\" or \"off\", got %q", c.WatchMode))
+		}
+		if c.WatchMode != watchOff && c.WatchStateCollectionName == "" {
+			errs = append(errs, errors.New("watchStateCollectionName must be set"))
+		}
+	case "memory":
+	default:
+		errs = append(errs, fmt.Errorf("store must be \"mongo\" or \"memory\", got %q", c.Store))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	_ "embed"
+	"strings"
+)
+
+// countriesCSV is the ISO 3166-1 table of the countries: alpha-2 code, alpha-3 code and English short name.
+//
+//go:embed countries.csv
+var countriesCSV string
+
+// countryInfo describes a country of the ISO 3166-1 table.
+type countryInfo struct {
+	Alpha3 string
+	Name   string
+}
+
+var (
+	// countries maps the alpha-2 code of every country to its description.
+	countries map[Country]countryInfo
+	// countryAliases maps the alpha-3 codes and upper-case names of the countries to their alpha-2 code.
+	countryAliases map[string]Country
+)
+
+// countryGroups maps the country groups usable in Condition.Country to their members.
+// Group names are not ISO 3166-1 codes.
+var countryGroups = map[Country][]Country{
+	"EU": {
+		"AT", "BE", "BG", "CY", "CZ", "DE", "DK", "EE", "ES", "FI", "FR", "GR", "HR", "HU",
+		"IE", "IT", "LT", "LU", "LV", "MT", "NL", "PL", "PT", "RO", "SE", "SI", "SK",
+	},
+	"EEA": {
+		"AT", "BE", "BG", "CY", "CZ", "DE", "DK", "EE", "ES", "FI", "FR", "GR", "HR", "HU",
+		"IE", "IS", "IT", "LI", "LT", "LU", "LV", "MT", "NL", "NO", "PL", "PT", "RO", "SE", "SI", "SK",
+	},
+	"ASEAN": {"BN", "ID", "KH", "LA", "MM", "MY", "PH", "SG", "TH", "VN"},
+	"APAC": {
+		"AU", "BD", "BN", "BT", "CN", "FJ", "FM", "HK", "ID", "IN", "JP", "KH", "KI", "KR",
+		"LA", "LK", "MH", "MM", "MN", "MO", "MV", "MY", "NP", "NR", "NZ", "PG", "PH", "PK",
+		"PW", "SB", "SG", "TH", "TL", "TO", "TV", "TW", "VN", "VU", "WS",
+	},
+	"LATAM": {
+		"AR", "BO", "BR", "CL", "CO", "CR", "CU", "DO", "EC", "GT", "HN", "HT", "MX", "NI",
+		"PA", "PE", "PY", "SV", "UY", "VE",
+	},
+	"MENA": {
+		"AE", "BH", "DZ", "EG", "IL", "IQ", "IR", "JO", "KW", "LB", "LY", "MA", "OM", "PS",
+		"QA", "SA", "SY", "TN", "YE",
+	},
+}
+
+func init() {
+	records := readReferenceTable(countriesCSV, "countries.csv")
+	countries = make(map[Country]countryInfo, len(records))
+	countryAliases = make(map[string]Country, 2*len(records))
+	for _, record := range records {
+		code := Country(record[0])
+		countries[code] = countryInfo{Alpha3: record[1], Name: record[2]}
+		countryAliases[record[1]] = code
+		countryAliases[strings.ToUpper(record[2])] = code
+	}
+}
+
+// ParseCountry returns the country with the alpha-2 code, alpha-3 code or name s,
+// in any case. Unknown values are returned in upper case and reported by IsValid.
+func ParseCountry(s string) Country {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if code, ok := countryAliases[s]; ok {
+		return code
+	}
+	return Country(s)
+}
+
+// Name returns the English short name of the country, or "" if it is unknown.
+func (c Country) Name() string {
+	return countries[c].Name
+}
+
+// IsGroup reports whether c is a country group rather than a country.
+func (c Country) IsGroup() bool {
+	_, ok := countryGroups[c]
+	return ok
+}
+
+// ExpandCountries returns list with the country groups replaced by their members,
+// keeping the first occurrence of each country. A nil list stays nil.
+func ExpandCountries(list []Country) []Country {
+	if list == nil {
+		return nil
+	}
+	expanded := []Country{}
+	seen := map[Country]bool{}
+	for _, c := range list {
+		members, ok := countryGroups[c]
+		if !ok {
+			members = []Country{c}
+		}
+		for _, member := range members {
+			if !seen[member] {
+				seen[member] = true
+				expanded = append(expanded, member)
+			}
+		}
+	}
+	return expanded
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Error codes returned in APIError.Code. They are stable and safe to match on.
+const (
+	CodeInvalidAge       = "INVALID_AGE"
+	CodeInvalidGender    = "INVALID_GENDER"
+	CodeInvalidCountry   = "INVALID_COUNTRY"
+	CodeInvalidRegion    = "INVALID_REGION"
+	CodeInvalidCity      = "INVALID_CITY"
+	CodeInvalidPlatform  = "INVALID_PLATFORM"
+	CodeInvalidCursor    = "INVALID_CURSOR"
+	CodeInvalidBody      = "INVALID_BODY"
+	CodeValidationFailed = "VALIDATION_FAILED"
+	CodeInvalidID        = "INVALID_ID"
+	CodeAdNotFound       = "AD_NOT_FOUND"
+	CodeAdConflict       = "AD_CONFLICT"
+	CodeIDMismatch       = "ID_MISMATCH"
+	CodeTooManyAds       = "TOO_MANY_ADS"
+	CodeNoTransactions   = "TRANSACTIONS_UNSUPPORTED"
+	CodeKeyNotFound      = "KEY_NOT_FOUND"
+	CodeUnauthorized     = "UNAUTHORIZED"
+	CodeForbidden        = "FORBIDDEN"
+	CodeRateLimited      = "RATE_LIMITED"
+	CodeRouteNotFound    = "ROUTE_NOT_FOUND"
+	CodeMethodNotAllowed = "METHOD_NOT_ALLOWED"
+	CodeDBUnavailable    = "DB_UNAVAILABLE"
+	CodeDBError          = "DB_ERROR"
+	CodeDeadlineExceeded = "DEADLINE_EXCEEDED"
+	CodeInternalError    = "INTERNAL_ERROR"
+)
+
+// statusClientClosedRequest is recorded for requests canceled by the client, as nginx does.
+const statusClientClosedRequest = 499
+
+// APIError is the error returned by every endpoint.
+type APIError struct {
+	Status    int          `json:"status"`
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	RequestID string       `json:"requestId,omitempty"`
+	Details   []FieldError `json:"details,omitempty"`
+
+	// Report is the outcome of each ad of a rejected bulk request or import.
+	Report interface{} `json:"report,omitempty"`
+}
+
+// ErrorResponse is the response body of a failed request.
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// respondError aborts the request with an error response.
+func respondError(c *gin.Context, status int, code, message string, details ...FieldError) {
+	respondErrorReport(c, status, code, message, nil, details...)
+}
+
+// respondErrorReport aborts the request with an error response including report.
+func respondErrorReport(c *gin.Context, status int, code, message string, report interface{}, details ...FieldError) {
+	c.Abort()
+	c.IndentedJSON(status, ErrorResponse{Error: APIError{
+		Status:    status,
+		Code:      code,
+		Message:   message,
+		RequestID: c.GetString(requestIDKey),
+		Details:   details,
+		Report:    report,
+	}})
+}
+
+// respondBindingError writes the response for a request body that cannot be decoded.
+func respondBindingError(c *gin.Context, err error) {
+	respondError(c, http.StatusBadRequest, CodeInvalidBody, "Failed binding data", bindingErrorDetails(err)...)
+}
+
+// bindingErrorDetails returns the field with a value of the wrong type in a decoding error, if any.
+func bindingErrorDetails(err error) []FieldError {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return []FieldError{{Field: typeErr.Field, Message: "must be of type " + typeErr.Type.String()}}
+	}
+	return nil
+}
+
+// notFound responds to requests for unknown routes.
+func notFound(c *gin.Context) {
+	respondError(c, http.StatusNotFound, CodeRouteNotFound, "route not found")
+}
+
+// methodNotAllowed responds to requests with an unsupported method.
+func methodNotAllowed(c *gin.Context) {
+	respondError(c, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method not allowed")
+}
+
+// recovery turns a panic in a handler into an internal error response.
+func recovery(c *gin.Context, err interface{}) {
+	requestLog(c).Error("panic while handling request", "error", err)
+	respondError(c, http.StatusInternalServerError, CodeInternalError, "internal server error")
+}
+
+const (
+	requestIDHeader = "X-Request-ID"
+	requestIDKey    = "requestID"
+)
+
+// validRequestID restricts propagated request IDs to short printable tokens.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestID propagates the X-Request-ID header of the request, or generates one,
+// and echoes it in the response.
+func requestID(c *gin.Context) {
+	id := c.GetHeader(requestIDHeader)
+	if !validRequestID.MatchString(id) {
+		id = newRequestID()
+	}
+	c.Set(requestIDKey, id)
+	c.Set(loggerKey, slog.Default().With("requestId", id))
+	c.Header(requestIDHeader, id)
+	c.Next()
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/gin-gonic/gin"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Sources of the location of a public search, reported in the geoSourceHeader response header.
+const (
+	geoSourceHeader = "X-Geo-Source"
+	// geoSourceQuery is a location given by the country, region or city query parameters.
+	geoSourceQuery = "query"
+	// geoSourceForwarded is a location inferred from the X-Forwarded-For header of a trusted proxy.
+	geoSourceForwarded = "x-forwarded-for"
+	// geoSourceRemote is a location inferred from the address of the connection.
+	geoSourceRemote = "remote-addr"
+	// geoSourceNone means the search has no location.
+	geoSourceNone = "none"
+)
+
+// geoLocator locates the clients of public searches without a location, or is nil when disabled.
+var geoLocator GeoLocator
+
+// GeoLocator finds the location of IP addresses.
+type GeoLocator interface {
+	// Locate returns the country of ip and its region, if known, and reports
+	// false if ip cannot be located.
+	Locate(ip net.IP) (Country, Region, bool, error)
+}
+
+// MaxMindLocator is a GeoLocator reading a local MaxMind database, such as GeoLite2 City or Country.
+type MaxMindLocator struct {
+	db *maxminddb.Reader
+}
+
+// maxMindRecord holds the fields read from a MaxMind database record.
+type maxMindRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+}
+
+// OpenMaxMindLocator opens the MaxMind database at path.
+func OpenMaxMindLocator(path string) (*MaxMindLocator, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &MaxMindLocator{db: db}, nil
+}
+
+func (l *MaxMindLocator) Locate(ip net.IP) (Country, Region, bool, error) {
+	var record maxMindRecord
+	_, found, err := l.db.LookupNetwork(ip, &record)
+	if err != nil || !found || record.Country.ISOCode == "" {
+		return "", "", false, err
+	}
+
+	country := Country(record.Country.ISOCode)
+	var region Region
+	// The first subdivision is the largest, such as the state of a city
+	if len(record.Subdivisions) > 0 {
+		region = ParseRegion(string(country) + "-" + record.Subdivisions[0].ISOCode)
+	}
+	return country, region, true, nil
+}
+
+// Close closes the database.
+func (l *MaxMindLocator) Close(ctx context.Context) error {
+	return l.db.Close()
+}
+
+// locateClient sets the country and region of query from the client IP when the
+// search has no location, and returns the source of the location of the search.
+// The client IP is read from X-Forwarded-For only when set by a trusted proxy.
+func locateClient(c *gin.Context, query *AdQuery) string {
+	if query.Country != "" {
+		return geoSourceQuery
+	}
+	if geoLocator == nil {
+		return geoSourceNone
+	}
+
+	clientIP := c.ClientIP()
+	country, region, found, err := geoLocator.Locate(net.ParseIP(clientIP))
+	switch {
+	case err != nil:
+		geoLookups.WithLabelValues("error").Inc()
+		requestLog(c).Warn("failed to locate client", "clientIP", clientIP, "error", err)
+		return geoSourceNone
+	case !found || !country.IsValid():
+		geoLookups.WithLabelValues("not_found").Inc()
+		return geoSourceNone
+	}
+	geoLookups.WithLabelValues("found").Inc()
+
+	query.Country = country
+	// Regions missing from the reference table would match no ad targeting regions
+	if region.IsValid() && region.Country() == country {
+		query.Region = region
+	}
+	if clientIP != c.RemoteIP() {
+		return geoSourceForwarded
+	}
+	return geoSourceRemote
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	statusOK          = "ok"
+	statusUnavailable = "unavailable"
+)
+
+// CheckResult is the outcome of a single readiness check.
+type CheckResult struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// HealthReport is the response body of the health endpoints.
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// getHealthz responds 200 as long as the process is able to serve requests.
+func getHealthz(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, HealthReport{Status: statusOK})
+}
+
+// getReadyz responds 200 when the server can serve ads, and 503 with the failing checks otherwise.
+func getReadyz(c *gin.Context) {
+	report := HealthReport{
+		Status: statusOK,
+		Checks: map[string]CheckResult{
+			"config":   checkConfig(),
+			"database": checkDatabase(),
+		},
+	}
+	// Indexes can only be listed once the database is reachable
+	if report.Checks["database"].Status == statusOK {
+		report.Checks["indexes"] = checkIndexes(c.Request.Context())
+	} else {
+		report.Checks["indexes"] = CheckResult{Status: statusUnavailable, Detail: "database unavailable"}
+	}
+
+	code := http.StatusOK
+	for _, check := range report.Checks {
+		if check.Status != statusOK {
+			report.Status = statusUnavailable
+			code = http.StatusServiceUnavailable
+		}
+	}
+	c.IndentedJSON(code, report)
+}
+
+// checkConfig verifies that the loaded configuration is valid.
+func checkConfig() CheckResult {
+	if err := cfg.Validate(); err != nil {
+		return CheckResult{Status: statusUnavailable, Detail: err.Error()}
+	}
+	return CheckResult{Status: statusOK}
+}
+
+// checkDatabase verifies that MongoDB answered a ping within the last few ping intervals.
+func checkDatabase() CheckResult {
+	if _, ok := baseAdStore().(*MongoAdStore); !ok {
+		return CheckResult{Status: statusOK, Detail: "in-memory store"}
+	}
+
+	status := mongoConn.Status()
+	if status.State != Connected {
+		detail := status.State.String()
+		if status.LastError != nil {
+			detail += ": " + status.LastError.Error()
+		}
+		return CheckResult{Status: statusUnavailable, Detail: detail}
+	}
+	maxAge := 3 * time.Duration(cfg.PingInterval)
+	if age := time.Since(status.LastPing); age > maxAge {
+		return CheckResult{Status: statusUnavailable, Detail: fmt.Sprintf("last successful ping %v ago", age.Round(time.Second))}
+	}
+	return CheckResult{Status: statusOK, Detail: "last successful ping at " + status.LastPing.UTC().Format(time.RFC3339)}
+}
+
+// checkIndexes verifies that the expected indexes of the ads collection exist.
+func checkIndexes(ctx context.Context) CheckResult {
+	store, ok := baseAdStore().(*MongoAdStore)
+	if !ok {
+		return CheckResult{Status: statusOK, Detail: "in-memory store"}
+	}
+
+	drift, err := store.VerifyIndexes(ctx)
+	if err != nil {
+		return CheckResult{Status: statusUnavailable, Detail: err.Error()}
+	}
+	// Extra indexes do not prevent serving
+	var problems []string
+	if len(drift.Missing) > 0 {
+		problems = append(problems, "missing "+strings.Join(drift.Missing, ", "))
+	}
+	if len(drift.Changed) > 0 {
+		problems = append(problems, "changed "+strings.Join(drift.Changed, ", "))
+	}
+	if len(problems) > 0 {
+		return CheckResult{Status: statusUnavailable, Detail: strings.Join(problems, "; ")}
+	}
+	return CheckResult{Status: statusOK}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IndexSpec describes an index of the ads collection.
+type IndexSpec struct {
+	Name string `bson:"name"`
+	Keys bson.D `bson:"key"`
+}
+
+// expectedIndexes are the indexes the ads collection must have for the public query.
+var expectedIndexes = []IndexSpec{
+	// Time window of active ads
+	{Name: "startAt_1_endAt_1", Keys: bson.D{{Key: "startAt", Value: 1}, {Key: "endAt", Value: 1}}},
+	// Sort key of search results
+	{Name: "endAt_1__id_1", Keys: bson.D{{Key: "endAt", Value: 1}, {Key: "_id", Value: 1}}},
+	// Condition fields used by $elemMatch
+	{Name: "conditions.country_1", Keys: bson.D{{Key: "conditions.country", Value: 1}}},
+	{Name: "conditions.region_1", Keys: bson.D{{Key: "conditions.region", Value: 1}}},
+	{Name: "conditions.city_1", Keys: bson.D{{Key: "conditions.city", Value: 1}}},
+	{Name: "conditions.platform_1", Keys: bson.D{{Key: "conditions.platform", Value: 1}}},
+	{Name: "conditions.gender_1", Keys: bson.D{{Key: "conditions.gender", Value: 1}}},
+	{Name: "conditions.ageStart_1_conditions.ageEnd_1", Keys: bson.D{{Key: "conditions.ageStart", Value: 1}, {Key: "conditions.ageEnd", Value: 1}}},
+}
+
+// defaultIndexName is the name of the index MongoDB creates on _id.
+const defaultIndexName = "_id_"
+
+// namespaceNotFoundCode is the MongoDB error code for a missing collection.
+const namespaceNotFoundCode = 26
+
+// IndexDrift lists the differences between the expected and the existing indexes.
+type IndexDrift struct {
+	Missing    []string
+	Changed    []string
+	Unexpected []string
+}
+
+// IsEmpty reports whether the existing indexes match the expected ones.
+func (d IndexDrift) IsEmpty() bool {
+	return len(d.Missing) == 0 && len(d.Changed) == 0 && len(d.Unexpected) == 0
+}
+
+// diffIndexes compares the existing indexes with the expected ones by name and keys.
+func diffIndexes(expected, existing []IndexSpec) IndexDrift {
+	var drift IndexDrift
+	byName := map[string]IndexSpec{}
+	for _, spec := range existing {
+		byName[spec.Name] = spec
+	}
+
+	known := map[string]bool{defaultIndexName: true}
+	for _, spec := range expected {
+		known[spec.Name] = true
+		current, ok := byName[spec.Name]
+		if !ok {
+			drift.Missing = append(drift.Missing, spec.Name)
+		} else if !sameKeys(spec.Keys, current.Keys) {
+			drift.Changed = append(drift.Changed, spec.Name)
+		}
+	}
+	for _, spec := range existing {
+		if !known[spec.Name] {
+			drift.Unexpected = append(drift.Unexpected, spec.Name)
+		}
+	}
+	return drift
+}
+
+// sameKeys reports whether two index key documents have the same fields, order and directions.
+func sameKeys(a, b bson.D) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		// The server may return directions as int32, int64 or double
+		if a[i].Key != b[i].Key || fmt.Sprint(a[i].Value) != fmt.Sprint(b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// logDrift logs every difference in drift.
+func logDrift(drift IndexDrift) {
+	for _, name := range drift.Missing {
+		slog.Warn("index is missing", "index", name)
+	}
+	for _, name := range drift.Changed {
+		slog.Warn("index has unexpected keys", "index", name)
+	}
+	for _, name := range drift.Unexpected {
+		slog.Warn("index is not in the expected set", "index", name)
+	}
+}
+
+// ListIndexes returns the indexes of the ads collection.
+func (s *MongoAdStore) ListIndexes(ctx context.Context) ([]IndexSpec, error) {
+	col, err := s.collection()
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := col.Indexes().List(ctx)
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == namespaceNotFoundCode {
+		// The collection does not exist yet
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var specs []IndexSpec
+	if err := cursor.All(ctx, &specs); err != nil {
+		return nil, err
+	}
+	return specs, nil
+}
+
+// VerifyIndexes compares the indexes of the ads collection with the expected set.
+func (s *MongoAdStore) VerifyIndexes(ctx context.Context) (IndexDrift, error) {
+	existing, err := s.ListIndexes(ctx)
+	if err != nil {
+		return IndexDrift{}, err
+	}
+	return diffIndexes(expectedIndexes, existing), nil
+}
+
+// EnsureIndexes creates the missing expected indexes, recreates the ones whose
+// keys changed and logs any other drift.
+func (s *MongoAdStore) EnsureIndexes(ctx context.Context) error {
+	drift, err := s.VerifyIndexes(ctx)
+	if err != nil {
+		return err
+	}
+	logDrift(drift)
+
+	var models []mongo.IndexModel
+	for _, spec := range expectedIndexes {
+		if slices.Contains(drift.Missing, spec.Name) || slices.Contains(drift.Changed, spec.Name) {
+			models = append(models, indexModel(spec))
+		}
+	}
+	if len(models) == 0 {
+		return nil
+	}
+	col, err := s.collection()
+	if err != nil {
+		return err
+	}
+	// An index cannot be created under the name of one with other keys
+	for _, name := range drift.Changed {
+		slog.Info("recreating index with the expected keys", "index", name)
+		if _, err := col.Indexes().DropOne(ctx, name); err != nil {
+			return err
+		}
+	}
+	_, err = col.Indexes().CreateMany(ctx, models)
+	return err
+}
+
+// RebuildIndexes drops every index except the one on _id and creates the expected set.
+func (s *MongoAdStore) RebuildIndexes(ctx context.Context) error {
+	col, err := s.collection()
+	if err != nil {
+		return err
+	}
+	if _, err := col.Indexes().DropAll(ctx); err != nil {
+		return err
+	}
+	var models []mongo.IndexModel
+	for _, spec := range expectedIndexes {
+		models = append(models, indexModel(spec))
+	}
+	_, err = col.Indexes().CreateMany(ctx, models)
+	return err
+}
+
+func indexModel(spec IndexSpec) mongo.IndexModel {
+	return mongo.IndexModel{Keys: spec.Keys, Options: options.Index().SetName(spec.Name)}
+}
+
+// runIndexCommand implements the "indexes" command and returns the process exit code.
+func runIndexCommand(args []string) int {
+	mongoConn = NewConnectionManager()
+	if err := mongoConn.Connect(); err != nil {
+		slog.Error("failed to connect to MongoDB", "error", err)
+		return 1
+	}
+	defer mongoConn.Close(context.Background())
+
+	ctx := context.Background()
+	store := NewMongoAdStore()
+	action := "list"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	switch action {
+	case "list":
+		specs, err := store.ListIndexes(ctx)
+		if err != nil {
+			slog.Error("failed to list indexes", "error", err)
+			return 1
+		}
+		for _, spec := range specs {
+			fmt.Printf("%s\t%v\n", spec.Name, spec.Keys)
+		}
+	case "verify":
+		drift, err := store.VerifyIndexes(ctx)
+		if err != nil {
+			slog.Error("failed to verify indexes", "error", err)
+			return 1
+		}
+		logDrift(drift)
+		if !drift.IsEmpty() {
+			return 1
+		}
+		slog.Info("indexes match the expected set")
+	case "rebuild":
+		if err := store.RebuildIndexes(ctx); err != nil {
+			slog.Error("failed to rebuild indexes", "error", err)
+			return 1
+		}
+		slog.Info("indexes rebuilt")
+	default:
+		slog.Error("unknown indexes action, expected list, verify or rebuild", "action", action)
+		return 2
+	}
+	return 0
+}
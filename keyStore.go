@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrKeyNotFound is returned when no API key exists for the given ID or hash.
+var ErrKeyNotFound = errors.New("api key not found")
+
+// KeyStore persists API keys. Only the hash of a key is stored.
+type KeyStore interface {
+	// CreateKey stores a new key and returns its generated ID.
+	CreateKey(ctx context.Context, key APIKey) (string, error)
+	// FindKeyByHash returns the key with the given hash, including revoked keys.
+	FindKeyByHash(ctx context.Context, hash string) (APIKey, error)
+	// ListKeys returns every key, including revoked keys.
+	ListKeys(ctx context.Context) ([]APIKey, error)
+	// RevokeKey marks the key with the given ID as revoked at the given time.
+	RevokeKey(ctx context.Context, id string, at time.Time) error
+}
+
+// keyStore is the store of API keys used by the handlers, selected at startup.
+var keyStore KeyStore
+
+// newKeyStore returns the key store matching the configured ad store.
+func newKeyStore() KeyStore {
+	if cfg.Store == "memory" {
+		return NewMemoryKeyStore()
+	}
+	return NewMongoKeyStore()
+}
+
+// MemoryKeyStore is a KeyStore that keeps keys in process memory.
+type MemoryKeyStore struct {
+	mu   sync.RWMutex
+	keys []APIKey
+}
+
+// NewMemoryKeyStore returns an empty in-memory KeyStore.
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{}
+}
+
+func (s *MemoryKeyStore) CreateKey(ctx context.Context, key APIKey) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key.ID = primitive.NewObjectID()
+	s.keys = append(s.keys, key)
+	return key.ID.Hex(), nil
+}
+
+func (s *MemoryKeyStore) FindKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return APIKey{}, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, key := range s.keys {
+		if key.Hash == hash {
+			return key, nil
+		}
+	}
+	return APIKey{}, ErrKeyNotFound
+}
+
+func (s *MemoryKeyStore) ListKeys(ctx context.Context) ([]APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]APIKey{}, s.keys...), nil
+}
+
+func (s *MemoryKeyStore) RevokeKey(ctx context.Context, id string, at time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !primitive.IsValidObjectID(id) {
+		return ErrInvalidID
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, key := range s.keys {
+		if key.ID.Hex() == id {
+			if key.RevokedAt == nil {
+				s.keys[i].RevokedAt = &at
+			}
+			return nil
+		}
+	}
+	return ErrKeyNotFound
+}
+
+// MongoKeyStore is a KeyStore backed by a MongoDB collection next to the ads collection.
+type MongoKeyStore struct{}
+
+// NewMongoKeyStore returns a KeyStore that uses MongoDB.
+func NewMongoKeyStore() *MongoKeyStore {
+	return &MongoKeyStore{}
+}
+
+// collection returns the API keys collection, or an error while the database is unavailable.
+func (s *MongoKeyStore) collection() (*mongo.Collection, error) {
+	client, err := mongoConn.Client()
+	if err != nil {
+		return nil, err
+	}
+	return client.Database(cfg.DBName).Collection(cfg.KeyCollectionName), nil
+}
+
+// EnsureIndexes creates the unique index used to look keys up by hash.
+func (s *MongoKeyStore) EnsureIndexes(ctx context.Context) error {
+	col, err := s.collection()
+	if err != nil {
+		return err
+	}
+	_, err = col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "hash", Value: 1}},
+		Options: options.Index().SetName("hash_1").SetUnique(true),
+	})
+	return err
+}
+
+func (s *MongoKeyStore) CreateKey(ctx context.Context, key APIKey) (string, error) {
+	col, err := s.collection()
+	if err != nil {
+		return "", err
+	}
+	key.ID = primitive.NewObjectID()
+	if _, err := col.InsertOne(ctx, key); err != nil {
+		return "", err
+	}
+	return key.ID.Hex(), nil
+}
+
+func (s *MongoKeyStore) FindKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	var key APIKey
+	col, err := s.collection()
+	if err != nil {
+		return key, err
+	}
+	err = col.FindOne(ctx, bson.M{"hash": hash}).Decode(&key)
+	if err == mongo.ErrNoDocuments {
+		return key, ErrKeyNotFound
+	}
+	return key, err
+}
+
+func (s *MongoKeyStore) ListKeys(ctx context.Context) ([]APIKey, error) {
+	col, err := s.collection()
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := col.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	keys := []APIKey{}
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *MongoKeyStore) RevokeKey(ctx context.Context, id string, at time.Time) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrInvalidID
+	}
+	col, err := s.collection()
+	if err != nil {
+		return err
+	}
+	// Keep the original revocation time of an already revoked key
+	res, err := col.UpdateOne(ctx,
+		bson.M{"_id": oid},
+		bson.A{bson.M{"$set": bson.M{"revokedAt": bson.M{"$ifNull": bson.A{"$revokedAt", at}}}}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
+}
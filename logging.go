@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// loggerKey is the gin context key of the request logger.
+const loggerKey = "logger"
+
+// setupLogging makes the default logger write JSON lines at the given level.
+// Messages of the standard log package, such as those of net/http, go through it too.
+func setupLogging(w io.Writer, level string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: l})))
+	return nil
+}
+
+// requestLog returns the logger of the request, which adds its ID to every line.
+func requestLog(c *gin.Context) *slog.Logger {
+	if logger, ok := c.Get(loggerKey); ok {
+		return logger.(*slog.Logger)
+	}
+	return slog.Default()
+}
+
+// accessLog logs every request once it is handled, as an error for server errors.
+func accessLog(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	status := c.Writer.Status()
+	level := slog.LevelInfo
+	if status >= 500 {
+		level = slog.LevelError
+	}
+	requestLog(c).Log(c.Request.Context(), level, "request",
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"query", c.Request.URL.RawQuery,
+		"route", c.FullPath(),
+		"status", status,
+		"durationMs", float64(time.Since(start).Microseconds())/1000,
+		"bytes", c.Writer.Size(),
+		"clientIP", c.ClientIP(),
+	)
+}
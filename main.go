@@ -2,225 +2,502 @@ package main
 
 import (
 	"context"
-	"log"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"os"
-	"sort"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/gin-gonic/gin/binding"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func main() {
-	os.Setenv("DB_NAME", "development_api")
-	os.Setenv("COLLECTION_NAME", "ads")
+	config, args, err := LoadConfig(os.Args[1:])
+	if err != nil {
+		fatal("invalid configuration", err)
+	}
+	cfg = config
+	if err := setupLogging(os.Stderr, cfg.LogLevel); err != nil {
+		fatal("invalid log level", err)
+	}
+	gin.SetMode(gin.ReleaseMode)
 
-	router := gin.Default()
-	router.GET("/api/v1/ad", getAds)
-	router.POST("/api/v1/ad", addAds)
+	// Manage the indexes of the ads collection and exit
+	if len(args) > 0 && args[0] == "indexes" {
+		os.Exit(runIndexCommand(args[1:]))
+	}
 
-	// Start the server in a separate goroutine
-	go func() {
-		if err := router.Run("localhost:8080"); err != nil {
-			log.Fatalf("Failed to start server: %v", err)
+	adStore = newAdStore()
+	if cfg.ResponseCacheTTL > 0 {
+		adCache = NewResponseCache(cfg.ResponseCacheSize, time.Duration(cfg.ResponseCacheTTL))
+	}
+	keyStore = newKeyStore()
+	rateLimiter = newRateLimiter()
+	if cfg.GeoIPDatabase != "" {
+		locator, err := OpenMaxMindLocator(cfg.GeoIPDatabase)
+		if err != nil {
+			fatal("failed to open GeoIP database", err)
+		}
+		geoLocator = locator
+	}
+	indexed, _ := adStore.(*IndexedAdStore)
+	if indexed != nil {
+		// Cached responses were computed from the previous index
+		indexed.onRebuild = adCache.Clear
+	}
+	if store, ok := baseAdStore().(*MongoAdStore); ok {
+		mongoConn = NewConnectionManager()
+		mongoConn.onConnect = func(ctx context.Context) {
+			if err := store.EnsureIndexes(ctx); err != nil {
+				slog.Error("failed to ensure indexes", "error", err)
+			}
+			if indexed != nil {
+				indexed.Invalidate()
+			}
+			if keys, ok := keyStore.(*MongoKeyStore); ok {
+				if err := keys.EnsureIndexes(ctx); err != nil {
+					slog.Error("failed to ensure API key indexes", "error", err)
+				}
+			}
+			if limiter, ok := rateLimiter.(*MongoRateLimiter); ok {
+				if err := limiter.EnsureIndexes(ctx); err != nil {
+					slog.Error("failed to ensure rate limit indexes", "error", err)
+				}
+			}
 		}
-	}()
+		mongoConn.Start()
+	}
+	if indexed != nil {
+		indexed.Start()
+	}
+	var watcher *AdWatcher
+	if mongoConn != nil && cfg.WatchMode != watchOff {
+		// Follow the writes of other instances
+		watcher = NewAdWatcher(func() {
+			adCache.Clear()
+			if indexed != nil {
+				indexed.Invalidate()
+			}
+		})
+		watcher.Start()
+	}
 
-	// Block the main goroutine indefinitely
-	select {}
-}
+	router := newRouter()
 
-// getAds responds with the list of all ads as JSON.
-func getAds(c *gin.Context) {
-	_, err := getClient()
+	// Stop on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := newServer(router)
+	ln, err := net.Listen("tcp", srv.Addr)
 	if err != nil {
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "Failed to connect to database"})
-		return
+		fatal("failed to start server", err)
 	}
+	slog.Info("listening", "addr", ln.Addr().String())
 
-	// Get the current time
-	currentTime := time.Now()
-
-	// Construct a basic MongoDB query based on the query parameters
-	filter := bson.M{
-		"startAt": bson.M{"$lte": currentTime},
-		"endAt":   bson.M{"$gte": currentTime},
-		"conditions": bson.M{
-			"$elemMatch": bson.M{},
-		},
+	var closers []func(context.Context) error
+	if locator, ok := geoLocator.(*MaxMindLocator); ok {
+		closers = append(closers, locator.Close)
+	}
+	if watcher != nil {
+		closers = append(closers, watcher.Close)
 	}
+	if indexed != nil {
+		closers = append(closers, indexed.Close)
+	}
+	if mongoConn != nil {
+		closers = append(closers, mongoConn.Close)
+	}
+	if err := serve(ctx, srv, ln, closers...); err != nil {
+		fatal("failed to shut down cleanly", err)
+	}
+	slog.Info("server stopped")
+}
+
+// fatal logs err and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// newRouter returns the router serving every endpoint of the API.
+func newRouter() *gin.Engine {
+	router := gin.New()
+	router.HandleMethodNotAllowed = true
+	// Proxies are validated with the configuration
+	_ = router.SetTrustedProxies(cfg.TrustedProxies)
+	router.Use(requestID, observeRequest, accessLog, gin.CustomRecoveryWithWriter(io.Discard, recovery), requestDeadline)
+	router.NoRoute(notFound)
+	router.NoMethod(methodNotAllowed)
+
+	router.GET("/healthz", getHealthz)
+	router.GET("/readyz", getReadyz)
+	router.GET("/metrics", metricsHandler)
+	router.GET("/api/v1/ad", rateLimitByIP, publicAccess, rateLimitByKey, getAds)
+
+	adminAuth := gin.HandlersChain{rateLimitByIP, requireAPIKey, rateLimitByKey}
+	admin := router.Group("/api/v1", adminAuth...)
+	admin.POST("/ad", requirePermission(PermCreateAds), addAds)
+	// gin cannot register /ads:bulk next to /ads:import, so the custom methods share a
+	// path parameter and authenticate once the method is known
+	router.GET("/api/v1/ads:action", adsActions(adminAuth, map[string]gin.HandlersChain{
+		"export": {requirePermission(PermReadAds), exportAds},
+	}))
+	router.POST("/api/v1/ads:action", adsActions(adminAuth, map[string]gin.HandlersChain{
+		"bulk":   {requirePermission(PermCreateAds), bulkAds},
+		"import": {requirePermission(PermCreateAds), requirePermission(PermUpdateAds), importAds},
+	}))
+	admin.GET("/ad/:id", requirePermission(PermReadAds), getAd)
+	admin.PUT("/ad/:id", requirePermission(PermUpdateAds), updateAd)
+	admin.PATCH("/ad/:id", requirePermission(PermUpdateAds), patchAd)
+	admin.POST("/ad/:id/approve", requirePermission(PermApproveAds), approveAd)
+	admin.DELETE("/ad/:id", requirePermission(PermDeleteAds), deleteAd)
+	admin.POST("/keys", requirePermission(PermManageKeys), createKey)
+	admin.GET("/keys", requirePermission(PermManageKeys), listKeys)
+	admin.DELETE("/keys/:id", requirePermission(PermManageKeys), revokeKey)
+
+	return router
+}
 
+// getAds responds with the list of all ads as JSON.
+func getAds(c *gin.Context) {
 	// Extract query parameter
 	ageCondition := c.Query("age")
 	genderCondition := c.Query("gender")
 	countryCondition := c.Query("country")
+	regionCondition := c.Query("region")
+	cityCondition := c.Query("city")
 	platformCondition := c.Query("platform")
 
-	// Construct age query
-	ageFilter := bson.M{}
+	var query AdQuery
+
+	// Validate age query
 	if ageCondition != "" {
 		age, err := strconv.Atoi(ageCondition)
 		if err != nil {
-			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid age parameter"})
+			respondError(c, http.StatusBadRequest, CodeInvalidAge, "invalid age parameter")
 			return
 		}
-		ageFilter = bson.M{
-			"ageStart": bson.M{"$lte": age},
-			"ageEnd":   bson.M{"$gte": age},
-		}
+		query.Age = &age
 	}
 
-	// Construct gender query
-	genderFilter := bson.M{}
+	// Validate gender query
 	if genderCondition != "" {
-		genderEnum := Gender(genderCondition)
-		if !genderEnum.IsValid() {
-			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid gender parameter"})
+		query.Gender = Gender(genderCondition)
+		if !query.Gender.IsValid() {
+			respondError(c, http.StatusBadRequest, CodeInvalidGender, "invalid gender parameter")
 			return
 		}
-		genderFilter = bson.M{
-			"$or": []bson.M{
-				{"gender": bson.M{"$in": []Gender{genderEnum}}},
-				{"gender": nil}, // Empty array
-			},
-		}
 	}
 
-	// Construct country query
-	countryFilter := bson.M{}
+	// Validate country query
 	if countryCondition != "" {
-		countryEnum := Country(countryCondition)
-		if !countryEnum.IsValid() {
-			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid country parameter"})
+		query.Country = ParseCountry(countryCondition)
+		if !query.Country.IsValid() {
+			respondError(c, http.StatusBadRequest, CodeInvalidCountry, "invalid country parameter")
+			return
+		}
+	}
+
+	// Validate region and city queries, which imply their country and region
+	if regionCondition != "" {
+		query.Region = ParseRegion(regionCondition)
+		if !query.Region.IsValid() {
+			respondError(c, http.StatusBadRequest, CodeInvalidRegion, "invalid region parameter")
 			return
 		}
-		countryFilter = bson.M{
-			"$or": []bson.M{
-				{"country": bson.M{"$in": []Country{countryEnum}}},
-				{"country": nil}, // Empty array
-			},
+	}
+	if cityCondition != "" {
+		query.City = ParseCity(cityCondition)
+		if !query.City.IsValid() {
+			respondError(c, http.StatusBadRequest, CodeInvalidCity, "invalid city parameter; "+citiesCoverage())
+			return
 		}
 	}
+	if !query.completeGeo() {
+		respondError(c, http.StatusBadRequest, CodeInvalidRegion, "region, city and country parameters do not match")
+		return
+	}
 
-	// Construct platform query
-	platformFilter := bson.M{}
+	// Validate platform query
 	if platformCondition != "" {
-		platformEnum := Platform(platformCondition)
-		if !platformEnum.IsValid() {
-			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "invalid platform parameter"})
+		query.Platform = Platform(platformCondition)
+		if !query.Platform.IsValid() {
+			respondError(c, http.StatusBadRequest, CodeInvalidPlatform, "invalid platform parameter")
 			return
 		}
-		platformFilter = bson.M{
-			"$or": []bson.M{
-				{"platform": bson.M{"$in": []Platform{platformEnum}}},
-				{"platform": nil}, // Empty array
-			},
+	}
+
+	// Extract pagination parameters; invalid values are ignored
+	page := Page{Limit: -1}
+	if offset, err := strconv.Atoi(c.Query("offset")); err == nil && offset > 0 {
+		page.Offset = offset
+	}
+	if limit, err := strconv.Atoi(c.Query("limit")); err == nil && limit >= 0 {
+		page.Limit = limit
+	}
+	if cursorParam := c.Query("cursor"); cursorParam != "" {
+		after, err := DecodeCursor(cursorParam)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, CodeInvalidCursor, "invalid cursor parameter")
+			return
 		}
+		page.After = &after
 	}
 
-	// Combine all condition filters into a single filter for $elemMatch
-	conditionFilter := bson.M{
-		"$elemMatch": bson.M{
-			"$and": []bson.M{ageFilter, genderFilter, countryFilter, platformFilter},
-		},
+	// Searches without a location are located from the client IP
+	geoSource := locateClient(c, &query)
+	c.Header(geoSourceHeader, geoSource)
+
+	now := time.Now()
+	cacheKey := responseCacheKey(query, page)
+	displayAds, generation, cached := adCache.Get(cacheKey, now)
+	if !cached {
+		var err error
+		displayAds, err = findDisplayAds(c.Request.Context(), now, query, page)
+		if err != nil {
+			respondStoreError(c, err)
+			return
+		}
+		// Cache the response until an ad matching the query starts or ends
+		if adCache != nil {
+			if next, err := adStore.NextChange(c.Request.Context(), now, query); err == nil {
+				adCache.Set(cacheKey, generation, displayAds, now, next)
+			} else {
+				requestLog(c).Warn("failed to find the next ad change", "error", err)
+			}
+		}
 	}
-	filter["conditions"] = conditionFilter
 
-	// Apply filter in db
-	cursor, err := dbCol.Find(context.Background(), filter)
+	publicResultSize.Observe(float64(len(displayAds.Items)))
+	requestLog(c).Info("searched ads",
+		"age", ageCondition,
+		"gender", genderCondition,
+		"country", countryCondition,
+		"region", regionCondition,
+		"city", cityCondition,
+		"geoSource", geoSource,
+		"geoCountry", query.Country,
+		"platform", platformCondition,
+		"offset", page.Offset,
+		"limit", page.Limit,
+		"cursor", page.After != nil,
+		"matched", len(displayAds.Items),
+		"cached", cached,
+	)
+
+	c.IndentedJSON(http.StatusOK, displayAds)
+}
+
+// findDisplayAds returns the page of ads active at now that match query, with the cursor of the next page.
+func findDisplayAds(ctx context.Context, now time.Time, query AdQuery, page Page) (DisplayAds, error) {
+	// Fetch one extra ad to know whether there is a next page
+	limit := page.Limit
+	if limit > 0 {
+		page.Limit++
+	}
+
+	items, err := adStore.FindActiveAds(ctx, now, query, page)
 	if err != nil {
-		// Handle error
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "database error"})
-		return
+		return DisplayAds{}, err
 	}
-	defer cursor.Close(context.Background())
 
 	// Define http response body element
 	displayAds := DisplayAds{
-		Items: []AdItem{},
+		Items: items,
 	}
-
-	// Iterate over the cursor to retrieve the documents
-	for cursor.Next(context.Background()) {
-		var ad Advertisement
-		if err := cursor.Decode(&ad); err != nil {
-			// Handle error
-			c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "error decoding documents in data type"})
-			return
-		}
-		// Append an ad to displayAds.Items
-		displayAds.Items = append(displayAds.Items, AdItem{Title: ad.Title, EndAt: ad.EndAt})
+	if limit > 0 && len(items) > limit {
+		displayAds.Items = items[:limit]
+		last := displayAds.Items[limit-1]
+		displayAds.NextCursor = EncodeCursor(PageCursor{EndAt: last.EndAt, ID: last.ID})
 	}
-	if err := cursor.Err(); err != nil {
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	return displayAds, nil
+}
+
+// addAds adds an ad from JSON received in the request body.
+func addAds(c *gin.Context) {
+	var newAd Advertisement
+
+	// Call BindJSON to bind the received JSON to newAd.
+	if err := c.ShouldBindJSON(&newAd); err != nil {
+		respondBindingError(c, err)
+		return
+	} else if errs := ValidateAdvertisement(newAd); len(errs) > 0 {
+		respondValidationErrors(c, errs)
 		return
 	}
 
-	// Handle condition where no ads is found for specified query
-	if len(displayAds.Items) == 0 {
-		c.IndentedJSON(http.StatusOK, displayAds)
+	// The ID is always assigned by the store, and new ads wait for approval
+	newAd.ID = primitive.NilObjectID
+	newAd.Status = AdPending
+	normalizeConditions(newAd.Conditions)
+
+	// Add the new ad to the db.
+	id, err := adStore.InsertAd(c.Request.Context(), newAd)
+	if err != nil {
+		respondStoreError(c, err)
 		return
 	}
+	adCache.Clear()
+	newAd.ID, _ = primitive.ObjectIDFromHex(id)
+	c.IndentedJSON(http.StatusCreated, newAd)
+}
 
-	// apply pagination
-	sort.Slice(displayAds.Items, func(i, j int) bool {
-		return displayAds.Items[i].EndAt.Before(displayAds.Items[j].EndAt)
-	})
-
-	offset, _ := strconv.Atoi(c.Query("offset"))
-	if offset >= len(displayAds.Items) {
-		c.IndentedJSON(http.StatusOK, DisplayAds{
-			Items: []AdItem{},
-		})
+// getAd responds with the ad whose ID is given in the path.
+func getAd(c *gin.Context) {
+	ad, err := adStore.GetAd(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondStoreError(c, err)
 		return
 	}
+	c.IndentedJSON(http.StatusOK, ad)
+}
 
-	limit, err_l := strconv.Atoi(c.Query("limit"))
-	endIndex := offset
-	if err_l == nil {
-		endIndex += limit
-		if endIndex > len(displayAds.Items) {
-			endIndex = len(displayAds.Items)
-		}
-	} else {
-		endIndex = len(displayAds.Items)
+// updateAd replaces the ad whose ID is given in the path with the JSON request body.
+func updateAd(c *gin.Context) {
+	id := c.Param("id")
+
+	var ad Advertisement
+	if err := c.ShouldBindJSON(&ad); err != nil {
+		respondBindingError(c, err)
+		return
+	} else if errs := ValidateAdvertisement(ad); len(errs) > 0 {
+		respondValidationErrors(c, errs)
+		return
 	}
-	displayAds.Items = displayAds.Items[offset:endIndex]
-	//println(displayAds.Items)
 
-	c.IndentedJSON(http.StatusOK, displayAds)
+	saveAd(c, id, ad)
 }
 
-// addAds adds an ad from JSON received in the request body.
-func addAds(c *gin.Context) {
-	// connect to database
-	_, err := getClient()
+// patchAd applies the fields present in the JSON request body to the ad whose ID is given in the path.
+func patchAd(c *gin.Context) {
+	id := c.Param("id")
+
+	ad, err := adStore.GetAd(c.Request.Context(), id)
 	if err != nil {
-		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": "Failed to connect to database"})
+		respondStoreError(c, err)
 		return
 	}
 
-	var newAd Advertisement
+	// Fields missing from the body keep their current value, while conditions in
+	// the body replace the current ones instead of being decoded into them
+	conditions := ad.Conditions
+	ad.Conditions = nil
+	var fields map[string]json.RawMessage
+	if err := c.ShouldBindBodyWith(&ad, binding.JSON); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+	// The body already decoded as an object
+	_ = c.ShouldBindBodyWith(&fields, binding.JSON)
+	if _, ok := fields["conditions"]; !ok {
+		ad.Conditions = conditions
+	}
+	if errs := ValidateAdvertisement(ad); len(errs) > 0 {
+		respondValidationErrors(c, errs)
+		return
+	}
 
-	// Call BindJSON to bind the received JSON to newAd.
-	if err := c.ShouldBindJSON(&newAd); err != nil {
-		c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Failed binding data"})
+	saveAd(c, id, ad)
+}
+
+// deleteAd removes the ad whose ID is given in the path.
+func deleteAd(c *gin.Context) {
+	if err := adStore.DeleteAd(c.Request.Context(), c.Param("id")); err != nil {
+		respondStoreError(c, err)
 		return
-	} else {
-		// Check if required fields are present
-		if newAd.Title == "" || newAd.StartAt.IsZero() || newAd.EndAt.IsZero() {
-			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
-			return
-		}
 	}
+	adCache.Clear()
+	c.Status(http.StatusNoContent)
+}
 
-	// Add the new ad to the db.
-	_, err = dbCol.InsertOne(context.Background(), newAd)
+// approveAd approves the ad whose ID is given in the path, so it is served.
+func approveAd(c *gin.Context) {
+	id := c.Param("id")
+	if err := adStore.ApproveAd(c.Request.Context(), id); err != nil {
+		respondStoreError(c, err)
+		return
+	}
+	adCache.Clear()
+	ad, err := adStore.GetAd(c.Request.Context(), id)
 	if err != nil {
-		c.IndentedJSON(http.StatusInternalServerError, "Failed adding data to database")
+		respondStoreError(c, err)
 		return
 	}
-	c.IndentedJSON(http.StatusCreated, newAd)
+	c.IndentedJSON(http.StatusOK, ad)
+}
+
+// saveAd stores ad under id and responds with the stored ad.
+// An ID in the body that differs from the one in the path is a conflict.
+func saveAd(c *gin.Context, id string, ad Advertisement) {
+	if !ad.ID.IsZero() && ad.ID.Hex() != id {
+		respondError(c, http.StatusConflict, CodeIDMismatch, "ad id in body does not match path")
+		return
+	}
+
+	// Changed ads are served again once approved
+	ad.Status = AdPending
+	normalizeConditions(ad.Conditions)
+	if err := adStore.UpdateAd(c.Request.Context(), id, ad); err != nil {
+		respondStoreError(c, err)
+		return
+	}
+	adCache.Clear()
+	ad.ID, _ = primitive.ObjectIDFromHex(id)
+	c.IndentedJSON(http.StatusOK, ad)
+}
+
+// respondValidationErrors writes a 400 response listing every invalid field.
+func respondValidationErrors(c *gin.Context, errs ValidationErrors) {
+	respondError(c, http.StatusBadRequest, CodeValidationFailed, "Validation failed", errs...)
+}
+
+// respondStoreError writes the HTTP response matching an error returned by the AdStore.
+func respondStoreError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidID):
+		respondError(c, http.StatusBadRequest, CodeInvalidID, "invalid ad id")
+	case errors.Is(err, ErrAdNotFound):
+		respondError(c, http.StatusNotFound, CodeAdNotFound, "ad not found")
+	case errors.Is(err, ErrAdConflict):
+		respondError(c, http.StatusConflict, CodeAdConflict, "ad already exists")
+	case errors.Is(err, ErrStoreUnavailable) || errors.Is(err, mongo.ErrClientDisconnected):
+		// The client of a lost connection may be closed under a pending operation
+		respondUnavailable(c, err)
+	case errors.Is(err, ErrAtomicUnsupported):
+		respondError(c, http.StatusNotImplemented, CodeNoTransactions, "atomic inserts require a MongoDB replica set")
+	case errors.Is(err, context.Canceled):
+		// The client went away, nobody reads the response
+		requestLog(c).Info("request canceled by client")
+		c.AbortWithStatus(statusClientClosedRequest)
+	case errors.Is(err, context.DeadlineExceeded) || mongo.IsTimeout(err):
+		requestLog(c).Warn("request deadline exceeded", "error", err)
+		respondError(c, http.StatusGatewayTimeout, CodeDeadlineExceeded, "request deadline exceeded")
+	default:
+		requestLog(c).Error("database error", "error", err)
+		respondError(c, http.StatusInternalServerError, CodeDBError, "database error")
+	}
+}
+
+// respondUnavailable writes a 503 response telling the client when the database may be back.
+func respondUnavailable(c *gin.Context, err error) {
+	requestLog(c).Warn("database unavailable", "error", err)
+	retryAfter := time.Second
+	var unavailable *StoreUnavailableError
+	if errors.As(err, &unavailable) {
+		retryAfter = max(unavailable.RetryAfter, retryAfter)
+	}
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	respondError(c, http.StatusServiceUnavailable, CodeDBUnavailable, "Failed to connect to database")
 }
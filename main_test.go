@@ -3,72 +3,76 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func TestMain(m *testing.M) {
-	os.Setenv("DB_NAME", "test_api")
-	os.Setenv("COLLECTION_NAME", "ads")
+	cfg.DBName = "test_api"
+	cfg.Store = "memory"
 
-	// Set up MongoDB connection
-	clientOptions := options.Client().ApplyURI("mongodb://localhost:27017")
-	client, err := mongo.Connect(context.Background(), clientOptions)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Create a test database and collection
-	testDB := client.Database("test_api")
-	testCollection := testDB.Collection("ads")
+	// Use the in-memory store so the tests do not need a running database
+	store := NewMemoryAdStore()
+	adStore = store
+	keyStore = NewMemoryKeyStore()
 
 	test_time, _ := ParseTime("2023-04-01T00:00:00.000Z")
 	test_end_time, _ := ParseTime("2099-05-31T00:00:00.000Z")
-	// Insert test data into the collection
-	testData := []interface{}{
-		bson.M{"title": "Test Ad 1", "startAt": test_time, "endAt": test_time.AddDate(0, 1, 0), "conditions": []bson.M{
-			bson.M{
-				"ageStart": 40,
-				"ageEnd":   60,
-				"gender":   []Gender{"M"},
-				"country":  []Country{"TW", "JP"},
-				"platform": []Platform{"android", "ios"},
+	// Insert test data into the store
+	testData := []Advertisement{
+		{Title: "Test Ad 1", StartAt: test_time, EndAt: test_time.AddDate(0, 1, 0), Conditions: []Condition{
+			{
+				AgeStart: 40,
+				AgeEnd:   60,
+				Gender:   []Gender{"M"},
+				Country:  []Country{"TW", "JP"},
+				Platform: []Platform{"android", "ios"},
 			},
 		}},
-		bson.M{"title": "Test Ad 2", "startAt": test_time, "endAt": test_end_time, "conditions": []bson.M{
-			bson.M{
-				"ageStart": 20,
-				"ageEnd":   30,
-				"gender":   nil,
-				"country":  []Country{"KR", "JP"},
-				"platform": []Platform{"ios"},
+		{Title: "Test Ad 2", StartAt: test_time, EndAt: test_end_time, Conditions: []Condition{
+			{
+				AgeStart: 20,
+				AgeEnd:   30,
+				Gender:   nil,
+				Country:  []Country{"KR", "JP"},
+				Platform: []Platform{"ios"},
 			},
 		}},
 		// Add more test data as needed
 	}
-	_, err = testCollection.InsertMany(context.Background(), testData)
-	if err != nil {
-		log.Fatal(err)
+	for _, ad := range testData {
+		if _, err := store.InsertAd(context.Background(), ad); err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	// Run the tests
 	exitCode := m.Run()
 
-	// Delete all documents from the collection
-	_, err = testCollection.DeleteMany(context.Background(), bson.M{})
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	// Exit with the same exit code as the tests
 	os.Exit(exitCode)
 }
@@ -105,8 +109,15 @@ func TestAdminAPISuccess(t *testing.T) {
 	// Check if the status code is 201
 	assert.Equal(t, http.StatusCreated, rr.Code)
 
+	// The response contains the generated ID
+	var body map[string]interface{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	assert.True(t, primitive.IsValidObjectID(body["id"].(string)))
+	delete(body, "id")
+
 	expected := `{
 		"title": "AD test",
+		"status": "pending",
 		"startAt": "2023-12-10T03:00:00.000Z",
 		"endAt": "2024-12-31T16:00:00.000Z",
 		"conditions": [{
@@ -118,7 +129,8 @@ func TestAdminAPISuccess(t *testing.T) {
 			}]
 		}`
 	// Assert that the response body matches the expected JSON
-	assert.JSONEq(t, expected, rr.Body.String())
+	actual, _ := json.Marshal(body)
+	assert.JSONEq(t, expected, string(actual))
 }
 
 func TestAdminAPIMissingRequiredField(t *testing.T) {
@@ -152,13 +164,314 @@ func TestAdminAPIMissingRequiredField(t *testing.T) {
 	// Check if the status code is 400
 	assert.Equal(t, http.StatusBadRequest, rr.Code)
 
-	expected := `{
-		"error": "Missing required fields"
-	}`
+	expected := `{"error": {
+		"status": 400,
+		"code": "VALIDATION_FAILED",
+		"message": "Validation failed",
+		"details": [{"field": "title", "message": "is required"}]
+	}}`
 	// Assert that the response body matches the expected JSON
 	assert.JSONEq(t, expected, rr.Body.String())
 }
 
+func TestAdminAPIValidationErrors(t *testing.T) {
+	router := gin.Default()
+	router.POST("/api/v1/ad", addAds)
+
+	payload := []byte(`{
+		"title": "AD test",
+		"startAt": "2024-12-31T16:00:00.000Z",
+		"endAt": "2023-12-10T03:00:00.000Z",
+		"conditions": [{
+			"ageStart": 20,
+			"ageEnd": 30,
+			"gender": ["m"],
+			"country": ["TW"],
+			"platform": ["IOS"]
+		}, {
+			"ageStart": 50,
+			"ageEnd": 101,
+			"gender": ["X"],
+			"country": ["ZZ", "jp"],
+			"platform": ["tv"]
+		}]
+	}`)
+
+	req, err := http.NewRequest("POST", "/api/v1/ad", bytes.NewBuffer(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	expected := `{"error": {
+		"status": 400,
+		"code": "VALIDATION_FAILED",
+		"message": "Validation failed",
+		"details": [
+			{"field": "startAt", "message": "must be before endAt"},
+			{"field": "conditions[1].ageEnd", "message": "must be between 1 and 100"},
+			{"field": "conditions[1].gender[0]", "message": "must be one of M, F"},
+			{"field": "conditions[1].country[0]", "message": "must be an ISO 3166-1 country or a country group"},
+			{"field": "conditions[1].platform[0]", "message": "must be one of ios, android, web"}
+		]
+	}}`
+	assert.JSONEq(t, expected, rr.Body.String())
+}
+
+func TestValidateAdvertisement(t *testing.T) {
+	start, _ := ParseTime("2024-01-01T00:00:00.000Z")
+	valid := Advertisement{
+		Title:      "Valid",
+		StartAt:    start,
+		EndAt:      start.AddDate(0, 1, 0),
+		Conditions: []Condition{{AgeStart: 1, AgeEnd: 100, Gender: []Gender{Female}}},
+	}
+	assert.Empty(t, ValidateAdvertisement(valid))
+
+	invalid := valid
+	invalid.Title = strings.Repeat("a", 101)
+	invalid.EndAt = invalid.StartAt
+	invalid.Conditions = []Condition{{AgeStart: 40, AgeEnd: 30}, {AgeStart: 0, AgeEnd: 20}}
+	assert.Equal(t, ValidationErrors{
+		{Field: "title", Message: "must be at most 100 characters, got 101"},
+		{Field: "startAt", Message: "must be before endAt"},
+		{Field: "conditions[0].ageStart", Message: "must be less than or equal to ageEnd"},
+		{Field: "conditions[1].ageStart", Message: "must be between 1 and 100"},
+	}, ValidateAdvertisement(invalid))
+}
+
+func TestCountries(t *testing.T) {
+	assert.Len(t, countries, 249)
+	for _, c := range []Country{Taiwan, Japan, United_States, Korea, Thailand, "FR", "BR", "ZA"} {
+		assert.True(t, c.IsValid(), c)
+	}
+	assert.False(t, Country("XX").IsValid())
+	assert.False(t, Country("EU").IsValid())
+	assert.True(t, Country("EU").IsGroup())
+	assert.Equal(t, "Japan", Japan.Name())
+
+	assert.Equal(t, Country("JP"), ParseCountry("jp"))
+	assert.Equal(t, Country("JP"), ParseCountry("JPN"))
+	assert.Equal(t, Country("KR"), ParseCountry(" south korea "))
+	assert.Equal(t, Country("CI"), ParseCountry("Côte d'Ivoire"))
+	assert.Equal(t, Country("XX"), ParseCountry("xx"))
+	for group, members := range countryGroups {
+		for _, member := range members {
+			assert.True(t, member.IsValid(), "%s of %s", member, group)
+		}
+	}
+
+	assert.Nil(t, ExpandCountries(nil))
+	assert.Equal(t, []Country{}, ExpandCountries([]Country{}))
+	assert.Equal(t, []Country{"TW", "BN", "ID", "KH", "LA", "MM", "MY", "PH", "SG", "TH", "VN"},
+		ExpandCountries([]Country{"TW", "ASEAN", "TH"}))
+
+	// Country groups are validated as given, then expanded
+	var ad Advertisement
+	assert.NoError(t, json.Unmarshal([]byte(`{"title": "Groups", "startAt": "2024-01-01T00:00:00.000Z", "endAt": "2024-02-01T00:00:00.000Z",
+		"conditions": [{"ageStart": 1, "ageEnd": 100, "country": ["EU", "XX"]}, {"ageStart": 1, "ageEnd": 100, "country": ["twn", "Japan", "EU"]}]}`), &ad))
+	assert.Equal(t, []Country{"TW", "JP", "EU"}, ad.Conditions[1].Country)
+	assert.Equal(t, ValidationErrors{{Field: "conditions[0].country[1]", Message: "must be an ISO 3166-1 country or a country group"}},
+		ValidateAdvertisement(ad))
+	normalizeConditions(ad.Conditions)
+	assert.Len(t, ad.Conditions[1].Country, 29)
+	assert.Equal(t, []Country{"TW", "JP", "AT"}, ad.Conditions[1].Country[:3])
+
+	router := gin.Default()
+	router.GET("/api/v1/ad", getAds)
+	search := func(country string) string {
+		req, _ := http.NewRequest("GET", "/api/v1/ad?age=25&country="+url.QueryEscape(country), nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		return rr.Body.String()
+	}
+	assert.Contains(t, search("JP"), "Test Ad 2")
+	assert.Equal(t, search("JP"), search("jpn"))
+	assert.Equal(t, search("JP"), search("Japan"))
+}
+
+func TestGeoTargeting(t *testing.T) {
+	assert.Equal(t, City("new-york"), ParseCity("New York"))
+	assert.Equal(t, City("tokyo"), ParseCity(" TOKYO "))
+	assert.Equal(t, Region("US-CA"), City("san-francisco").Region())
+	assert.Equal(t, Region("JP-13"), ParseRegion("jp-13"))
+	assert.Equal(t, Japan, Region("JP-13").Country())
+	assert.True(t, Region("TH-10").IsValid())
+	assert.Greater(t, len(regions), 5000)
+	for city, region := range cities {
+		assert.True(t, region.IsValid(), city)
+	}
+	for region := range regions {
+		assert.True(t, region.Country().IsValid(), region)
+	}
+
+	// Cities imply their region and country
+	conditions := make([]Condition, 2)
+	assert.NoError(t, json.Unmarshal([]byte(`[{"ageStart": 1, "ageEnd": 100, "city": ["Tokyo", "osaka"], "region": []}, {"ageStart": 1, "ageEnd": 100, "city": []}]`), &conditions))
+	normalizeConditions(conditions)
+	cond := conditions[0]
+	assert.Equal(t, []City{"tokyo", "osaka"}, cond.City)
+	assert.Equal(t, []Region{"JP-13", "JP-27"}, cond.Region)
+	assert.Equal(t, []Country{"JP"}, cond.Country)
+	cond = conditions[1]
+	assert.Nil(t, cond.City)
+	assert.Nil(t, cond.Region)
+	assert.Nil(t, cond.Country)
+
+	assert.Equal(t, ValidationErrors{
+		{Field: "c.region[0]", Message: "must be in a country of the condition"},
+		{Field: "c.region[1]", Message: "must be an ISO 3166-2 region of the reference table"},
+		{Field: "c.city[0]", Message: "must be in a region of the condition"},
+		{Field: "c.city[1]", Message: "must be a city of the reference table; city targeting is only available in JP, KR, TW, US"},
+		{Field: "c.country[0]", Message: "must contain a region of the condition"},
+		{Field: "c.region[0]", Message: "must contain a city of the condition"},
+	}, validateGeo("c", Condition{
+		Country: []Country{"US"},
+		Region:  []Region{"JP-13", "XX-01"},
+		City:    []City{"osaka", "atlantis"},
+	}))
+	assert.Equal(t, ValidationErrors{
+		{Field: "c.city[0]", Message: "must be in a country of the condition"},
+		{Field: "c.country[0]", Message: "must contain a region of the condition"},
+	}, validateGeo("c", Condition{Country: []Country{"US"}, City: []City{"tokyo"}}))
+	// Cities can only be targeted in the countries of the city table
+	assert.True(t, Japan.HasCities())
+	assert.False(t, Thailand.HasCities())
+	assert.Equal(t, ValidationErrors{
+		{Field: "c.city[0]", Message: "must be a city of the reference table; city targeting is only available in JP, KR, TW, US"},
+		{Field: "c.region[0]", Message: "has no city in the reference table; city targeting is only available in JP, KR, TW, US"},
+	}, validateGeo("c", Condition{Region: []Region{"TH-10"}, City: []City{"bangkok"}}))
+	assert.Equal(t, ValidationErrors{
+		{Field: "c.country[1]", Message: "must only have countries containing a region of the condition"},
+	}, validateGeo("c", Condition{Country: []Country{"US", "ASEAN"}, Region: []Region{"US-CA"}}))
+
+	defer func(previous AdStore) { adStore = previous }(adStore)
+	adStore = NewMemoryAdStore()
+	now := time.Now()
+	for i, targeting := range []string{`"country": ["JP"]`, `"city": ["tokyo"]`, `"region": ["JP-27"]`, `"country": ["US"]`} {
+		var ad Advertisement
+		assert.NoError(t, json.Unmarshal([]byte(`{"title": "Ad `+strconv.Itoa(i)+`", "conditions": [{"ageStart": 1, "ageEnd": 100, `+targeting+`}]}`), &ad))
+		ad.StartAt = now.Add(-time.Hour)
+		ad.EndAt = now.Add(time.Duration(i+1) * time.Hour)
+		assert.Empty(t, ValidateAdvertisement(ad))
+		normalizeConditions(ad.Conditions)
+		_, err := adStore.InsertAd(context.Background(), ad)
+		assert.NoError(t, err)
+	}
+
+	router := gin.Default()
+	router.GET("/api/v1/ad", getAds)
+	search := func(query string) (int, []string) {
+		req, _ := http.NewRequest("GET", "/api/v1/ad?"+query, nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		var body struct{ Items []AdItem }
+		json.Unmarshal(rr.Body.Bytes(), &body)
+		var titles []string
+		for _, item := range body.Items {
+			titles = append(titles, item.Title)
+		}
+		return rr.Code, titles
+	}
+	for query, expected := range map[string][]string{
+		"":                         {"Ad 0", "Ad 1", "Ad 2", "Ad 3"},
+		"country=JP":               {"Ad 0", "Ad 1", "Ad 2"},
+		"region=JP-13":             {"Ad 0", "Ad 1"},
+		"region=jp-13&country=jpn": {"Ad 0", "Ad 1"},
+		"city=Osaka":               {"Ad 0", "Ad 2"},
+		"city=new-york":            {"Ad 3"},
+	} {
+		code, titles := search(query)
+		assert.Equal(t, http.StatusOK, code, query)
+		assert.Equal(t, expected, titles, query)
+	}
+	for _, query := range []string{"region=XX-01", "city=atlantis", "country=US&region=JP-13", "region=JP-13&city=osaka"} {
+		code, _ := search(query)
+		assert.Equal(t, http.StatusBadRequest, code, query)
+	}
+}
+
+// mapLocator is a GeoLocator with fixed locations.
+type mapLocator map[string]Region
+
+func (l mapLocator) Locate(ip net.IP) (Country, Region, bool, error) {
+	if ip.String() == "192.0.2.99" {
+		return "", "", false, errors.New("corrupt database")
+	}
+	region, ok := l[ip.String()]
+	return region.Country(), region, ok, nil
+}
+
+func TestGeoIPLookup(t *testing.T) {
+	_, err := OpenMaxMindLocator(filepath.Join(t.TempDir(), "missing.mmdb"))
+	assert.Error(t, err)
+
+	defer func(previous AdStore, locator GeoLocator) { adStore, geoLocator = previous, locator }(adStore, geoLocator)
+	adStore = NewMemoryAdStore()
+	now := time.Now()
+	for i, targeting := range []string{`"country": ["JP"]`, `"region": ["JP-13"]`, `"country": ["US"]`} {
+		var ad Advertisement
+		assert.NoError(t, json.Unmarshal([]byte(`{"title": "Ad `+strconv.Itoa(i)+`", "conditions": [{"ageStart": 1, "ageEnd": 100, `+targeting+`}]}`), &ad))
+		ad.StartAt = now.Add(-time.Hour)
+		ad.EndAt = now.Add(time.Duration(i+1) * time.Hour)
+		normalizeConditions(ad.Conditions)
+		_, err := adStore.InsertAd(context.Background(), ad)
+		assert.NoError(t, err)
+	}
+
+	router := gin.New()
+	assert.NoError(t, router.SetTrustedProxies([]string{"10.0.0.0/8"}))
+	router.GET("/api/v1/ad", getAds)
+	search := func(query, remoteAddr, forwardedFor string) (string, []string) {
+		req, _ := http.NewRequest("GET", "/api/v1/ad?"+query, nil)
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code, query)
+		var body struct{ Items []AdItem }
+		json.Unmarshal(rr.Body.Bytes(), &body)
+		var titles []string
+		for _, item := range body.Items {
+			titles = append(titles, item.Title)
+		}
+		return rr.Header().Get(geoSourceHeader), titles
+	}
+
+	// Without a database, searches without a location match every ad
+	geoLocator = nil
+	source, titles := search("", "198.51.100.1:1234", "")
+	assert.Equal(t, geoSourceNone, source)
+	assert.Equal(t, []string{"Ad 0", "Ad 1", "Ad 2"}, titles)
+
+	geoLocator = mapLocator{"198.51.100.1": "JP-13", "198.51.100.2": "JP-27", "203.0.113.1": "US-CA"}
+	errorsBefore := testutil.ToFloat64(geoLookups.WithLabelValues("error"))
+	for _, tc := range []struct {
+		name, query, remoteAddr, forwardedFor, source string
+		titles                                        []string
+	}{
+		{"remote address", "", "198.51.100.1:1234", "", geoSourceRemote, []string{"Ad 0", "Ad 1"}},
+		{"other region", "", "198.51.100.2:1234", "", geoSourceRemote, []string{"Ad 0"}},
+		{"trusted proxy", "", "10.0.0.1:1234", "203.0.113.1", geoSourceForwarded, []string{"Ad 2"}},
+		{"untrusted proxy", "", "198.51.100.1:1234", "203.0.113.1", geoSourceRemote, []string{"Ad 0", "Ad 1"}},
+		{"unknown address", "", "192.0.2.1:1234", "", geoSourceNone, []string{"Ad 0", "Ad 1", "Ad 2"}},
+		{"lookup error", "", "192.0.2.99:1234", "", geoSourceNone, []string{"Ad 0", "Ad 1", "Ad 2"}},
+		{"query country", "country=US", "198.51.100.1:1234", "", geoSourceQuery, []string{"Ad 2"}},
+		{"query city", "city=osaka", "198.51.100.1:1234", "", geoSourceQuery, []string{"Ad 0"}},
+	} {
+		source, titles := search(tc.query, tc.remoteAddr, tc.forwardedFor)
+		assert.Equal(t, tc.source, source, tc.name)
+		assert.Equal(t, tc.titles, titles, tc.name)
+	}
+	assert.Equal(t, errorsBefore+1, testutil.ToFloat64(geoLookups.WithLabelValues("error")))
+}
+
 func TestAdminAPIFailedBindingData(t *testing.T) {
 	// Create a new Gin router instance
 	router := gin.Default()
@@ -191,13 +504,758 @@ func TestAdminAPIFailedBindingData(t *testing.T) {
 	// Check if the status code is 400
 	assert.Equal(t, http.StatusBadRequest, rr.Code)
 
-	expected := `{
-		"error": "Failed binding data"
-	}`
+	expected := `{"error": {
+		"status": 400,
+		"code": "INVALID_BODY",
+		"message": "Failed binding data",
+		"details": [{"field": "title", "message": "must be of type string"}]
+	}}`
 	// Assert that the response body matches the expected JSON
 	assert.JSONEq(t, expected, rr.Body.String())
 }
 
+func TestAdminAPICRUD(t *testing.T) {
+	router := gin.Default()
+	router.POST("/api/v1/ad", addAds)
+	router.GET("/api/v1/ad/:id", getAd)
+	router.PUT("/api/v1/ad/:id", updateAd)
+	router.PATCH("/api/v1/ad/:id", patchAd)
+	router.POST("/api/v1/ad/:id/approve", approveAd)
+	router.DELETE("/api/v1/ad/:id", deleteAd)
+
+	serve := func(method, path, payload string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve("POST", "/api/v1/ad", `{
+		"title": "CRUD test",
+		"startAt": "2023-12-10T03:00:00.000Z",
+		"endAt": "2024-12-31T16:00:00.000Z",
+		"conditions": [{"ageStart": 20, "ageEnd": 30}]
+	}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var created map[string]interface{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &created))
+	id := created["id"].(string)
+
+	rr = serve("GET", "/api/v1/ad/"+id, "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{
+		"id": "`+id+`",
+		"title": "CRUD test",
+		"status": "pending",
+		"startAt": "2023-12-10T03:00:00.000Z",
+		"endAt": "2024-12-31T16:00:00.000Z",
+		"conditions": [{"ageStart": 20, "ageEnd": 30, "gender": null, "country": null, "platform": null}]
+	}`, rr.Body.String())
+
+	rr = serve("POST", "/api/v1/ad/"+id+"/approve", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"status": "approved"`)
+	rr = serve("POST", "/api/v1/ad/"+primitive.NewObjectID().Hex()+"/approve", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// PATCH only changes the fields present in the body, and the ad waits for approval again
+	rr = serve("PATCH", "/api/v1/ad/"+id, `{"title": "CRUD patched", "status": "approved"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"title": "CRUD patched"`)
+	assert.Contains(t, rr.Body.String(), `"startAt": "2023-12-10T03:00:00.000Z"`)
+	assert.Contains(t, rr.Body.String(), `"status": "pending"`)
+
+	// Conditions in the body replace the current ones, and failed patches change nothing
+	rr = serve("PATCH", "/api/v1/ad/"+id, `{"conditions": [{"ageStart": 20, "ageEnd": 30, "gender": ["M"], "platform": ["ios"]}]}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = serve("PATCH", "/api/v1/ad/"+id, `{"conditions": [{"ageStart": 30, "ageEnd": 40}]}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	patched := `"conditions": [{"ageStart": 30, "ageEnd": 40, "gender": null, "country": null, "platform": null}]`
+	assert.JSONEq(t, `{"id": "`+id+`", "title": "CRUD patched", "status": "pending", "startAt": "2023-12-10T03:00:00.000Z", "endAt": "2024-12-31T16:00:00.000Z", `+patched+`}`, rr.Body.String())
+	rr = serve("PATCH", "/api/v1/ad/"+id, `{"conditions": [{"ageStart": 0, "ageEnd": 200}]}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	rr = serve("PATCH", "/api/v1/ad/"+id, `{"title": "CRUD patched"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = serve("GET", "/api/v1/ad/"+id, "")
+	assert.JSONEq(t, `{"id": "`+id+`", "title": "CRUD patched", "status": "pending", "startAt": "2023-12-10T03:00:00.000Z", "endAt": "2024-12-31T16:00:00.000Z", `+patched+`}`, rr.Body.String())
+
+	// PUT replaces the ad and is validated like POST
+	rr = serve("PUT", "/api/v1/ad/"+id, `{"title": "CRUD replaced"}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.JSONEq(t, `{"error": {
+		"status": 400,
+		"code": "VALIDATION_FAILED",
+		"message": "Validation failed",
+		"details": [
+			{"field": "startAt", "message": "is required"},
+			{"field": "endAt", "message": "is required"}
+		]
+	}}`, rr.Body.String())
+
+	rr = serve("PUT", "/api/v1/ad/"+id, `{
+		"title": "CRUD replaced",
+		"startAt": "2024-01-01T00:00:00.000Z",
+		"endAt": "2024-02-01T00:00:00.000Z"
+	}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"conditions": null`)
+
+	rr = serve("PUT", "/api/v1/ad/"+id, `{
+		"id": "`+primitive.NewObjectID().Hex()+`",
+		"title": "CRUD replaced",
+		"startAt": "2024-01-01T00:00:00.000Z",
+		"endAt": "2024-02-01T00:00:00.000Z"
+	}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	rr = serve("DELETE", "/api/v1/ad/"+id, "")
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+
+	rr = serve("GET", "/api/v1/ad/"+id, "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.JSONEq(t, `{"error": {"status": 404, "code": "AD_NOT_FOUND", "message": "ad not found"}}`, rr.Body.String())
+
+	rr = serve("DELETE", "/api/v1/ad/not-an-id", "")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.JSONEq(t, `{"error": {"status": 400, "code": "INVALID_ID", "message": "invalid ad id"}}`, rr.Body.String())
+}
+
+func TestAdminAPIBulk(t *testing.T) {
+	router := gin.Default()
+	router.POST("/api/v1/ads:action", adsActions(nil, map[string]gin.HandlersChain{"bulk": {bulkAds}}))
+
+	serve := func(path, payload string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", path, bytes.NewBufferString(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	ad := func(title string) string {
+		return `{"title": "` + title + `", "startAt": "2023-12-10T03:00:00.000Z", "endAt": "2024-12-31T16:00:00.000Z"}`
+	}
+	ids := func(rr *httptest.ResponseRecorder) []string {
+		var report BulkReport
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+		var ids []string
+		for _, result := range report.Results {
+			if result.ID != "" {
+				ids = append(ids, result.ID)
+			}
+		}
+		return ids
+	}
+	var created []string
+
+	// A JSON array
+	rr := serve("/api/v1/ads:bulk", "["+ad("Bulk 1")+", "+ad("Bulk 2")+"]")
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	created = append(created, ids(rr)...)
+	assert.Len(t, created, 2)
+	ad1, err := adStore.GetAd(context.Background(), created[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "Bulk 1", ad1.Title)
+
+	// JSONL, where invalid lines do not prevent the others from being created
+	rr = serve("/api/v1/ads:bulk", ad("Bulk 3")+"\n\n"+`{"title": ""}`+"\n"+`{"title": 5}`+"\nnot json\n"+ad("Bulk 4")+"\n")
+	assert.Equal(t, http.StatusMultiStatus, rr.Code)
+	var report BulkReport
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+	assert.Equal(t, 2, report.Created)
+	assert.Equal(t, 3, report.Failed)
+	assert.Equal(t, []int{1, 3, 4, 5, 6}, []int{report.Results[0].Line, report.Results[1].Line,
+		report.Results[2].Line, report.Results[3].Line, report.Results[4].Line})
+	assert.NotEmpty(t, report.Results[0].ID)
+	assert.Equal(t, "Validation failed", report.Results[1].Error)
+	assert.Contains(t, report.Results[1].Errors, FieldError{Field: "title", Message: "is required"})
+	assert.Equal(t, []FieldError{{Field: "title", Message: "must be of type string"}}, report.Results[2].Errors)
+	assert.Equal(t, "Failed binding data", report.Results[3].Error)
+	assert.NotEmpty(t, report.Results[4].ID)
+	created = append(created, ids(rr)...)
+
+	// Atomic requests create nothing when an ad is invalid
+	rr = serve("/api/v1/ads:bulk?atomic=true", "["+ad("Bulk 5")+`, {"title": ""}]`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	var rejected struct {
+		Error struct {
+			APIError
+			Report BulkReport `json:"report"`
+		} `json:"error"`
+	}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &rejected))
+	assert.Equal(t, CodeValidationFailed, rejected.Error.Code)
+	assert.Contains(t, rejected.Error.Details, FieldError{Field: "lines[2].title", Message: "is required"})
+	assert.Equal(t, 1, rejected.Error.Report.Failed)
+	assert.Empty(t, rejected.Error.Report.Results[0].ID)
+	rr = serve("/api/v1/ads:bulk?atomic=true", ad("Bulk 5")+"\n"+ad("Bulk 6"))
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	created = append(created, ids(rr)...)
+
+	rr = serve("/api/v1/ads:bulk", "["+ad("Bulk 7"))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code": "INVALID_BODY"`)
+
+	rr = serve("/api/v1/ads:bulk", " \n")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	defer func(max int) { cfg.BulkMaxAds = max }(cfg.BulkMaxAds)
+	cfg.BulkMaxAds = 1
+	rr = serve("/api/v1/ads:bulk", ad("Bulk 7")+"\n"+ad("Bulk 8"))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code": "TOO_MANY_ADS"`)
+
+	rr = serve("/api/v1/ads:other", "[]")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr = serve("/api/v1/adsbulk", "[]")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	assert.Len(t, created, 6)
+	for _, id := range created {
+		assert.NoError(t, adStore.DeleteAd(context.Background(), id))
+	}
+}
+
+// noTransactionAdStore is an AdStore failing atomic inserts like MongoDB without a replica set.
+type noTransactionAdStore struct {
+	AdStore
+}
+
+func (s noTransactionAdStore) InsertAds(ctx context.Context, ads []Advertisement, atomic bool) ([]string, error) {
+	if atomic {
+		return nil, fmt.Errorf("%w: transaction numbers are only allowed on a replica set member", ErrAtomicUnsupported)
+	}
+	return s.AdStore.InsertAds(ctx, ads, atomic)
+}
+
+func TestAdminAPIBulkAtomicUnsupported(t *testing.T) {
+	defer func(previous AdStore) { adStore = previous }(adStore)
+	store := NewMemoryAdStore()
+	indexed := NewIndexedAdStore(noTransactionAdStore{store}, time.Hour)
+	adStore = indexed
+
+	router := gin.Default()
+	router.POST("/api/v1/ads:action", adsActions(nil, map[string]gin.HandlersChain{"bulk": {bulkAds}}))
+	body := `{"title": "Atomic", "startAt": "2023-12-10T03:00:00.000Z", "endAt": "2024-12-31T16:00:00.000Z"}`
+	req, _ := http.NewRequest("POST", "/api/v1/ads:bulk?atomic=true", bytes.NewBufferString(body+"\n"+body))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	// Nothing was stored, so nothing is reported as created nor rebuilt
+	assert.Equal(t, http.StatusNotImplemented, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code": "TRANSACTIONS_UNSUPPORTED"`)
+	assert.Empty(t, indexed.rebuild)
+	count, err := store.CountActiveAds(context.Background(), time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC))
+	assert.NoError(t, err)
+	assert.Zero(t, count)
+}
+
+func TestAdminAPICSV(t *testing.T) {
+	defer func(previous AdStore) { adStore = previous }(adStore)
+	store := NewMemoryAdStore()
+	adStore = store
+
+	router := gin.Default()
+	router.GET("/api/v1/ads:action", adsActions(nil, map[string]gin.HandlersChain{"export": {exportAds}}))
+	router.POST("/api/v1/ads:action", adsActions(nil, map[string]gin.HandlersChain{"import": {importAds}}))
+	serve := func(method, path, payload string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	ctx := context.Background()
+	startAt, _ := ParseTime("2024-01-01T00:00:00.000Z")
+	endAt, _ := ParseTime("2024-02-01T00:00:00.000Z")
+	first, _ := store.InsertAd(ctx, Advertisement{Title: "First, with conditions", StartAt: startAt, EndAt: endAt, Conditions: []Condition{
+		{AgeStart: 20, AgeEnd: 30, Country: []Country{"TW", "JP"}, Platform: []Platform{}},
+		{AgeStart: 40, AgeEnd: 50, Gender: []Gender{"F"}},
+	}})
+	second, _ := store.InsertAd(ctx, Advertisement{Title: "Second", StartAt: startAt, EndAt: endAt})
+
+	rr := serve("GET", "/api/v1/ads:export", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", rr.Header().Get("Content-Type"))
+	exported := "id,ref,title,startAt,endAt,ageStart,ageEnd,gender,country,region,city,platform\n" +
+		first + ",,\"First, with conditions\",2024-01-01T00:00:00.000Z,2024-02-01T00:00:00.000Z,20,30,,TW|JP,,,-\n" +
+		first + ",,\"First, with conditions\",2024-01-01T00:00:00.000Z,2024-02-01T00:00:00.000Z,40,50,F,,,,\n" +
+		second + ",,Second,2024-01-01T00:00:00.000Z,2024-02-01T00:00:00.000Z,,,,,,,\n"
+	assert.Equal(t, exported, rr.Body.String())
+
+	// Importing the export changes nothing
+	rr = serve("POST", "/api/v1/ads:import?dryRun=false", exported)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"dryRun": false, "created": 0, "updated": 0, "unchanged": 2, "changes": []}`, rr.Body.String())
+
+	// Columns may be in any order, and values are normalized like JSON ones
+	changed := "title,id,ref,startAt,endAt,ageStart,ageEnd,gender,country,region,city,platform\n" +
+		"First renamed," + first + ",,2024-01-01T00:00:00Z,2024-02-01T00:00:00Z,20,30,,tw|jp,,,-\n" +
+		"First renamed," + first + ",,2024-01-01T00:00:00Z,2024-02-01T00:00:00Z,40,50,F,,,,\n" +
+		"Second," + second + ",,2024-01-01T00:00:00.000Z,2024-02-01T00:00:00.000Z,,,,,,,\n" +
+		"Third,,third,2024-01-01T00:00:00.000Z,2024-02-01T00:00:00.000Z,10,20,M,,,San Francisco,IOS\n" +
+		"Third,,third,2024-01-01T00:00:00.000Z,2024-02-01T00:00:00.000Z,30,40,,,,,web\n"
+	expected := `{"dryRun": true, "created": 1, "updated": 1, "unchanged": 1, "changes": [
+		{"row": 2, "action": "update", "id": "` + first + `", "fields": ["title"]},
+		{"row": 5, "action": "create", "ref": "third"}
+	]}`
+	rr = serve("POST", "/api/v1/ads:import", changed)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, expected, rr.Body.String())
+	ad, _ := store.GetAd(ctx, first)
+	assert.Equal(t, "First, with conditions", ad.Title)
+
+	rr = serve("POST", "/api/v1/ads:import?dryRun=false", changed)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var report ImportReport
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+	ad, _ = store.GetAd(ctx, first)
+	assert.Equal(t, "First renamed", ad.Title)
+	assert.Equal(t, AdPending, ad.Status)
+	ad, err := store.GetAd(ctx, report.Changes[1].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []Condition{
+		{AgeStart: 10, AgeEnd: 20, Gender: []Gender{"M"}, Country: []Country{"US"}, Region: []Region{"US-CA"},
+			City: []City{"san-francisco"}, Platform: []Platform{"ios"}},
+		{AgeStart: 30, AgeEnd: 40, Platform: []Platform{"web"}},
+	}, ad.Conditions)
+
+	// Every invalid cell is reported and nothing is written
+	rr = serve("POST", "/api/v1/ads:import?dryRun=false", "id,ref,title,startAt,endAt,ageStart,ageEnd,gender,country,region,city,platform\n"+
+		",fourth,Fourth,yesterday,2024-02-01T00:00:00.000Z,20,30,,,,,\n"+
+		",fourth,Fourth,yesterday,2024-02-01T00:00:00.000Z,0,x,,XX,,,\n"+
+		"not-an-id,,,2024-01-01T00:00:00.000Z,2024-02-01T00:00:00.000Z,,,,,,,\n")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.JSONEq(t, `{"error": {"status": 400, "code": "VALIDATION_FAILED", "message": "Validation failed",
+		"details": [
+			{"field": "rows[2].startAt", "message": "must be a time such as 2024-01-31T16:00:00.000Z"},
+			{"field": "rows[3].ageEnd", "message": "must be an integer"},
+			{"field": "rows[3].ageStart", "message": "must be between 1 and 100"},
+			{"field": "rows[3].country", "message": "must be an ISO 3166-1 country or a country group"},
+			{"field": "rows[4].id", "message": "must be an ad id"},
+			{"field": "rows[4].title", "message": "is required"}
+		],
+		"report": {"dryRun": false, "created": 2, "updated": 0, "unchanged": 0,
+			"changes": [{"row": 2, "action": "create", "ref": "fourth"}, {"row": 4, "action": "create"}],
+			"errors": [
+				{"row": 2, "column": "startAt", "message": "must be a time such as 2024-01-31T16:00:00.000Z"},
+				{"row": 3, "column": "ageEnd", "message": "must be an integer"},
+				{"row": 3, "column": "ageStart", "message": "must be between 1 and 100"},
+				{"row": 3, "column": "country", "message": "must be an ISO 3166-1 country or a country group"},
+				{"row": 4, "column": "id", "message": "must be an ad id"},
+				{"row": 4, "column": "title", "message": "is required"}
+			]}
+	}}`, rr.Body.String())
+	all, _ := store.FindLiveAds(ctx, time.Time{})
+	assert.Len(t, all, 3)
+
+	rr = serve("POST", "/api/v1/ads:import", "id,title\n")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code": "INVALID_BODY"`)
+}
+
+func TestCSVImportGrouping(t *testing.T) {
+	read := func(rows ...string) ([]csvAd, []ImportError) {
+		body := "id,ref,title,startAt,endAt,ageStart,ageEnd,gender,country,region,city,platform\n" + strings.Join(rows, "\n")
+		ads, errs, err := readCSVAds(strings.NewReader(body), 10)
+		assert.NoError(t, err)
+		return ads, errs
+	}
+	id := primitive.NewObjectID().Hex()
+
+	// Identical rows without id nor ref are distinct ads
+	ads, errs := read(
+		",,Same,2024-01-01T00:00:00.000Z,2024-02-01T00:00:00.000Z,10,20,,,,,",
+		",,Same,2024-01-01T00:00:00.000Z,2024-02-01T00:00:00.000Z,10,20,,,,,",
+	)
+	assert.Empty(t, errs)
+	assert.Len(t, ads, 2)
+
+	// Rows sharing an id or a ref are the conditions of one ad
+	ads, errs = read(
+		id+",,Known,2024-01-01T00:00:00.000Z,2024-02-01T00:00:00.000Z,10,20,,,,,",
+		id+",,Known,2024-01-01T00:00:00.000Z,2024-02-01T00:00:00.000Z,30,40,,,,,",
+		",a,New,2024-01-01T00:00:00.000Z,2024-02-01T00:00:00.000Z,10,20,,,,,",
+		",a,New,2024-01-01T00:00:00.000Z,2024-02-01T00:00:00.000Z,30,40,,,,,",
+		",b,New,2024-01-01T00:00:00.000Z,2024-02-01T00:00:00.000Z,10,20,,,,,",
+	)
+	assert.Empty(t, errs)
+	assert.Len(t, ads, 3)
+	assert.Equal(t, []int{2, 3}, ads[0].rows)
+	assert.Equal(t, []int{4, 5}, ads[1].rows)
+	assert.Equal(t, "a", ads[1].ref)
+
+	// The rows of an ad must agree, and a ref cannot be reused later
+	_, errs = read(
+		",a,New,2024-01-01T00:00:00.000Z,2024-02-01T00:00:00.000Z,10,20,,,,,",
+		",a,Renamed,2024-01-01T00:00:00.000Z,2024-02-01T00:00:00.000Z,30,40,,,,,",
+		",b,Other,2024-01-01T00:00:00.000Z,2024-02-01T00:00:00.000Z,10,20,,,,,",
+		",a,New,2024-01-01T00:00:00.000Z,2024-02-01T00:00:00.000Z,10,20,,,,,",
+	)
+	assert.Equal(t, []ImportError{
+		{Row: 3, Column: "title", Message: "must be the same as in the first row of the ad, row 2"},
+		{Row: 5, Column: "ref", Message: "is already used by the ad at row 2"},
+	}, errs)
+
+	// The ref column is optional, and unknown columns are rejected
+	_, _, err := readCSVAds(strings.NewReader("id,title,startAt,endAt,ageStart,ageEnd,gender,country,region,city,platform\n"), 10)
+	assert.NoError(t, err)
+	_, _, err = readCSVAds(strings.NewReader("id,ref,title,startAt,endAt,ageStart,ageEnd,gender,country,region,city,platform,extra\n"), 10)
+	assert.EqualError(t, err, "unknown column extra")
+}
+
+func TestCSVFormulaEscaping(t *testing.T) {
+	tests := []struct{ title, cell string }{
+		{"Spring sale", "Spring sale"},
+		{`=HYPERLINK("http://example.com")`, `'=HYPERLINK("http://example.com")`},
+		{"+1", "'+1"},
+		{"-20%", "'-20%"},
+		{"@home", "'@home"},
+		{"\tTabbed", "'\tTabbed"},
+		{"\rReturn", "'\rReturn"},
+		{"'quoted'", "'quoted'"},
+		{"'=already quoted", "''=already quoted"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.cell, escapeCSVText(test.title), test.title)
+		assert.Equal(t, test.title, unescapeCSVText(test.cell), test.cell)
+	}
+
+	// Exported titles are imported back unchanged
+	ad := Advertisement{ID: primitive.NewObjectID(), Title: "=1+1", StartAt: time.Now(), EndAt: time.Now().Add(time.Hour)}
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(csvColumns)
+	w.WriteAll(csvRows(ad))
+	assert.Contains(t, buf.String(), ",'=1+1,")
+	ads, errs, err := readCSVAds(&buf, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, errs)
+	assert.Equal(t, "=1+1", ads[0].ad.Title)
+}
+
+func TestMemoryAdStoreInsertAds(t *testing.T) {
+	store := NewMemoryAdStore()
+	ctx := context.Background()
+	existing := primitive.NewObjectID()
+	_, err := store.InsertAd(ctx, Advertisement{ID: existing, Title: "existing"})
+	assert.NoError(t, err)
+
+	ads := []Advertisement{{Title: "first"}, {ID: existing, Title: "duplicate"}}
+	ids, err := store.InsertAds(ctx, ads, true)
+	assert.ErrorIs(t, err, ErrAdConflict)
+	assert.Nil(t, ids)
+	// Only the existing ad is stored
+	count, _ := store.CountActiveAds(ctx, time.Time{})
+	assert.Equal(t, int64(1), count)
+
+	ids, err = store.InsertAds(ctx, ads, false)
+	assert.ErrorIs(t, err, ErrAdConflict)
+	assert.Len(t, ids, 2)
+	assert.Empty(t, ids[1])
+	ad, err := store.GetAd(ctx, ids[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "first", ad.Title)
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	router := gin.New()
+	router.HandleMethodNotAllowed = true
+	router.Use(requestID, gin.CustomRecovery(recovery))
+	router.NoRoute(notFound)
+	router.NoMethod(methodNotAllowed)
+	router.GET("/api/v1/ad", getAds)
+	router.GET("/panic", func(c *gin.Context) { panic("boom") })
+
+	serve := func(method, path, id string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != "" {
+			req.Header.Set("X-Request-ID", id)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// A valid request ID is propagated to the response
+	rr := serve("GET", "/api/v1/ad?age=abc", "req-123")
+	assert.Equal(t, "req-123", rr.Header().Get("X-Request-ID"))
+	assert.JSONEq(t, `{"error": {
+		"status": 400,
+		"code": "INVALID_AGE",
+		"message": "invalid age parameter",
+		"requestId": "req-123"
+	}}`, rr.Body.String())
+
+	// A missing or invalid request ID is replaced by a generated one
+	rr = serve("GET", "/nowhere", "bad id")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	var body ErrorResponse
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+	assert.Equal(t, "ROUTE_NOT_FOUND", body.Error.Code)
+	assert.Len(t, body.Error.RequestID, 32)
+	assert.Equal(t, body.Error.RequestID, rr.Header().Get("X-Request-ID"))
+
+	rr = serve("DELETE", "/api/v1/ad", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code": "METHOD_NOT_ALLOWED"`)
+
+	rr = serve("GET", "/panic", "")
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code": "INTERNAL_ERROR"`)
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	defer func(config Config) { cfg = config }(cfg)
+	cfg.AdminAPIKey = "bootstrap-secret"
+	router := newRouter()
+
+	serve := func(method, path, key, payload string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, bytes.NewBufferString(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	createKey := func(name, roles string) (string, string) {
+		rr := serve("POST", "/api/v1/keys", "bootstrap-secret", `{"name": "`+name+`", "roles": `+roles+`}`)
+		assert.Equal(t, http.StatusCreated, rr.Code)
+		var created map[string]interface{}
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &created))
+		assert.NotContains(t, created, "hash")
+		return created["id"].(string), created["key"].(string)
+	}
+
+	// Admin endpoints require a key
+	rr := serve("POST", "/api/v1/ad", "", `{}`)
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code": "UNAUTHORIZED"`)
+	rr = serve("GET", "/api/v1/keys", "ak_unknown", "")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	publicID, publicKey := createKey("mobile app", "[]")
+	_, adminKey := createKey("operations", `["admin"]`)
+
+	// A key without roles cannot use admin endpoints
+	rr = serve("POST", "/api/v1/ad", publicKey, `{}`)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code": "FORBIDDEN"`)
+
+	// A stored admin key can
+	rr = serve("GET", "/api/v1/keys", adminKey, "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"name": "mobile app"`)
+	assert.NotContains(t, rr.Body.String(), publicKey)
+
+	// The public endpoint is open unless configured otherwise
+	rr = serve("GET", "/api/v1/ad", "", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	cfg.RequirePublicKey = true
+	rr = serve("GET", "/api/v1/ad", "", "")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	rr = serve("GET", "/api/v1/ad", publicKey, "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// A revoked key is rejected
+	rr = serve("DELETE", "/api/v1/keys/"+publicID, adminKey, "")
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	rr = serve("GET", "/api/v1/ad", publicKey, "")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+
+	rr = serve("DELETE", "/api/v1/keys/"+primitive.NewObjectID().Hex(), adminKey, "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = serve("POST", "/api/v1/keys", adminKey, `{"name": "bad", "roles": ["owner"]}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"field": "roles[0]"`)
+}
+
+func TestRoleBasedAccessControl(t *testing.T) {
+	defer func(previous KeyStore) { keyStore = previous }(keyStore)
+	keyStore = NewMemoryKeyStore()
+	router := newRouter()
+
+	keys := map[Role]string{}
+	for _, role := range roles {
+		keys[role] = generateAPIKey()
+		keyStore.CreateKey(context.Background(), APIKey{Name: string(role), Roles: []Role{role}, Hash: hashAPIKey(keys[role])})
+	}
+	id, _ := adStore.InsertAd(context.Background(), Advertisement{Title: "RBAC test"})
+
+	serve := func(method, path string, role Role) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-API-Key", keys[role])
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// The status of each request tells whether the role was allowed to reach the handler
+	tests := []struct {
+		method, path string
+		allowed      []Role
+	}{
+		{"GET", "/api/v1/ad/" + id, []Role{RoleViewer, RoleEditor, RoleApprover, RoleAdmin}},
+		{"PATCH", "/api/v1/ad/" + id, []Role{RoleEditor, RoleApprover, RoleAdmin}},
+		{"POST", "/api/v1/ad", []Role{RoleEditor, RoleApprover, RoleAdmin}},
+		{"POST", "/api/v1/ad/not-an-id/approve", []Role{RoleApprover, RoleAdmin}},
+		{"DELETE", "/api/v1/ad/not-an-id", []Role{RoleApprover, RoleAdmin}},
+		{"GET", "/api/v1/ads:export", []Role{RoleViewer, RoleEditor, RoleApprover, RoleAdmin}},
+		{"POST", "/api/v1/ads:bulk", []Role{RoleEditor, RoleApprover, RoleAdmin}},
+		{"GET", "/api/v1/keys", []Role{RoleAdmin}},
+	}
+	for _, test := range tests {
+		for _, role := range roles {
+			rr := serve(test.method, test.path, role)
+			if slices.Contains(test.allowed, role) {
+				assert.NotEqual(t, http.StatusForbidden, rr.Code, "%s %s as %s", test.method, test.path, role)
+			} else {
+				assert.Equal(t, http.StatusForbidden, rr.Code, "%s %s as %s", test.method, test.path, role)
+			}
+		}
+	}
+
+	// Custom methods need a key, and unknown ones are not found without one
+	for path, status := range map[string]int{
+		"/api/v1/ads:bulk":  http.StatusUnauthorized,
+		"/api/v1/ads:other": http.StatusNotFound,
+		"/api/v1/adsbulk":   http.StatusNotFound,
+	} {
+		rr := serve("POST", path, "")
+		assert.Equal(t, status, rr.Code, path)
+	}
+
+	rr := serve("DELETE", "/api/v1/ad/"+id, RoleEditor)
+	assert.JSONEq(t, `{"error": {
+		"status": 403,
+		"code": "FORBIDDEN",
+		"message": "API key lacks permission ads:delete, granted by roles approver, admin",
+		"requestId": "`+rr.Header().Get("X-Request-ID")+`"
+	}}`, rr.Body.String())
+}
+
+func TestRateLimit(t *testing.T) {
+	defer func(config Config, limiter RateLimiter) { cfg, rateLimiter = config, limiter }(cfg, rateLimiter)
+	cfg.AdminAPIKey = "bootstrap-secret"
+	cfg.RateLimits = map[string]RateLimit{publicAdRoute: {Rate: 0.5, Burst: 2}}
+	rateLimiter = NewMemoryRateLimiter()
+	router := newRouter()
+
+	serve := func(ip, key string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "/api/v1/ad", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = ip + ":1234"
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// A client can use its burst, then has to wait for a token
+	rr := serve("192.0.2.1", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "2", rr.Header().Get("X-RateLimit-Limit"))
+	assert.Equal(t, "1", rr.Header().Get("X-RateLimit-Remaining"))
+	assert.Equal(t, "2", rr.Header().Get("X-RateLimit-Reset"))
+	rr = serve("192.0.2.1", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "0", rr.Header().Get("X-RateLimit-Remaining"))
+	rr = serve("192.0.2.1", "")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "2", rr.Header().Get("Retry-After"))
+	assert.Contains(t, rr.Body.String(), `"code": "RATE_LIMITED"`)
+
+	// Other addresses have their own bucket, and a key does not bypass the one of its address
+	rr = serve("192.0.2.2", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = serve("192.0.2.1", "bootstrap-secret")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+
+	// A valid key has a bucket shared by every address
+	rr = serve("192.0.2.4", "bootstrap-secret")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = serve("192.0.2.5", "bootstrap-secret")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = serve("192.0.2.6", "bootstrap-secret")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+
+	// An invalid key is rejected rather than ignored, once the address has a token
+	rr = serve("192.0.2.7", "ak_unknown")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	rr = serve("192.0.2.7", "ak_unknown")
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	rr = serve("192.0.2.7", "ak_unknown")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+
+	// Routes without a limit are not counted
+	rr = serve("192.0.2.1", "")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	hr := httptest.NewRecorder()
+	router.ServeHTTP(hr, req)
+	assert.Equal(t, http.StatusOK, hr.Code)
+	assert.Empty(t, hr.Header().Get("X-RateLimit-Limit"))
+
+	// Nor are routes with a zero burst
+	cfg.RateLimits = map[string]RateLimit{publicAdRoute: {Rate: 0, Burst: 0}}
+	assert.NoError(t, cfg.Validate())
+	for i := 0; i < 3; i++ {
+		rr = serve("192.0.2.3", "")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Empty(t, rr.Header().Get("X-RateLimit-Limit"))
+	}
+}
+
+func TestMemoryRateLimiter(t *testing.T) {
+	limiter := NewMemoryRateLimiter()
+	limit := RateLimit{Rate: 2, Burst: 3}
+	now := time.Now()
+
+	for i := 2; i >= 0; i-- {
+		d, err := limiter.Take(context.Background(), "client", limit, now)
+		assert.NoError(t, err)
+		assert.True(t, d.Allowed)
+		assert.Equal(t, i, d.Remaining)
+	}
+	d, _ := limiter.Take(context.Background(), "client", limit, now)
+	assert.False(t, d.Allowed)
+	assert.Equal(t, 500*time.Millisecond, d.RetryAfter)
+	assert.Equal(t, 1500*time.Millisecond, d.ResetAfter)
+
+	// Tokens are refilled at the configured rate, up to the burst
+	d, _ = limiter.Take(context.Background(), "client", limit, now.Add(500*time.Millisecond))
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 0, d.Remaining)
+	d, _ = limiter.Take(context.Background(), "client", limit, now.Add(time.Hour))
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 2, d.Remaining)
+}
+
 func TestPublicAPISuccess(t *testing.T) {
 	//testCollection := setupTestDB()
 
@@ -263,9 +1321,11 @@ func TestPublicAPIInvalidAgeParameter(t *testing.T) {
 	// Check if the status code is 400
 	assert.Equal(t, http.StatusBadRequest, rr.Code)
 
-	expected := `{
-		"error": "invalid age parameter"
-	}`
+	expected := `{"error": {
+		"status": 400,
+		"code": "INVALID_AGE",
+		"message": "invalid age parameter"
+	}}`
 	assert.JSONEq(t, expected, rr.Body.String())
 
 	// Clean up test data after tests
@@ -299,9 +1359,11 @@ func TestPublicAPIInvalidGenderParameter(t *testing.T) {
 	// Check if the status code is 400
 	assert.Equal(t, http.StatusBadRequest, rr.Code)
 
-	expected := `{
-		"error": "invalid gender parameter"
-	}`
+	expected := `{"error": {
+		"status": 400,
+		"code": "INVALID_GENDER",
+		"message": "invalid gender parameter"
+	}}`
 	assert.JSONEq(t, expected, rr.Body.String())
 
 	// Clean up test data after tests
@@ -335,9 +1397,11 @@ func TestPublicAPIInvalidCountryParameter(t *testing.T) {
 	// Check if the status code is 400
 	assert.Equal(t, http.StatusBadRequest, rr.Code)
 
-	expected := `{
-		"error": "invalid country parameter"
-	}`
+	expected := `{"error": {
+		"status": 400,
+		"code": "INVALID_COUNTRY",
+		"message": "invalid country parameter"
+	}}`
 	assert.JSONEq(t, expected, rr.Body.String())
 
 	// Clean up test data after tests
@@ -371,9 +1435,11 @@ func TestPublicAPIInvalidPlatformParameter(t *testing.T) {
 	// Check if the status code is OK
 	assert.Equal(t, http.StatusBadRequest, rr.Code)
 
-	expected := `{
-		"error": "invalid platform parameter"
-	}`
+	expected := `{"error": {
+		"status": 400,
+		"code": "INVALID_PLATFORM",
+		"message": "invalid platform parameter"
+	}}`
 	assert.JSONEq(t, expected, rr.Body.String())
 
 	// Clean up test data after tests
@@ -418,3 +1484,979 @@ func TestPublicAPIEmptyItems(t *testing.T) {
 	//	log.Fatal(err)
 	//}
 }
+
+func TestPublicAPIPagination(t *testing.T) {
+	// Use a dedicated store for this test
+	defer func(previous AdStore) { adStore = previous }(adStore)
+	store := NewMemoryAdStore()
+	adStore = store
+
+	start, _ := ParseTime("2023-01-01T00:00:00.000Z")
+	for _, end := range []string{"2099-03-01T00:00:00.000Z", "2099-01-01T00:00:00.000Z", "2099-02-01T00:00:00.000Z"} {
+		endAt, _ := ParseTime(end)
+		store.InsertAd(context.Background(), Advertisement{Title: "Ends " + end[:7], StartAt: start, EndAt: endAt, Conditions: []Condition{{AgeStart: 1, AgeEnd: 100}}})
+	}
+
+	router := gin.Default()
+	router.GET("/api/v1/ad", getAds)
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"", []string{"Ends 2099-01", "Ends 2099-02", "Ends 2099-03"}},
+		{"?offset=1", []string{"Ends 2099-02", "Ends 2099-03"}},
+		{"?offset=1&limit=1", []string{"Ends 2099-02"}},
+		{"?offset=5&limit=1", []string{}},
+		{"?limit=0", []string{}},
+		{"?offset=abc&limit=abc", []string{"Ends 2099-01", "Ends 2099-02", "Ends 2099-03"}},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "/api/v1/ad"+test.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var body struct {
+			Items []struct {
+				Title string `json:"title"`
+			} `json:"items"`
+		}
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+		titles := []string{}
+		for _, item := range body.Items {
+			titles = append(titles, item.Title)
+		}
+		assert.Equal(t, test.expected, titles, test.query)
+	}
+}
+
+func TestPublicAPICursorPagination(t *testing.T) {
+	// Use a dedicated store for this test
+	defer func(previous AdStore) { adStore = previous }(adStore)
+	store := NewMemoryAdStore()
+	adStore = store
+
+	start, _ := ParseTime("2023-01-01T00:00:00.000Z")
+	insert := func(title, end string) {
+		endAt, _ := ParseTime(end)
+		store.InsertAd(context.Background(), Advertisement{Title: title, StartAt: start, EndAt: endAt, Conditions: []Condition{{AgeStart: 1, AgeEnd: 100}}})
+	}
+	insert("A", "2099-01-01T00:00:00.000Z")
+	insert("B", "2099-01-01T00:00:00.000Z")
+	insert("C", "2099-02-01T00:00:00.000Z")
+
+	router := gin.Default()
+	router.GET("/api/v1/ad", getAds)
+
+	fetch := func(query string) ([]string, string) {
+		req, err := http.NewRequest("GET", "/api/v1/ad"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var body struct {
+			Items []struct {
+				Title string `json:"title"`
+			} `json:"items"`
+			NextCursor string `json:"nextCursor"`
+		}
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &body))
+		titles := []string{}
+		for _, item := range body.Items {
+			titles = append(titles, item.Title)
+		}
+		return titles, body.NextCursor
+	}
+
+	titles, cursor := fetch("?limit=2")
+	assert.Equal(t, []string{"A", "B"}, titles)
+	assert.NotEmpty(t, cursor)
+
+	// An ad inserted before the cursor position does not shift the next page
+	insert("Earlier", "2098-01-01T00:00:00.000Z")
+
+	titles, cursor = fetch("?limit=2&cursor=" + cursor)
+	assert.Equal(t, []string{"C"}, titles)
+	assert.Empty(t, cursor)
+
+	req, _ := http.NewRequest("GET", "/api/v1/ad?cursor=not-a-cursor", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.JSONEq(t, `{"error": {"status": 400, "code": "INVALID_CURSOR", "message": "invalid cursor parameter"}}`, rr.Body.String())
+}
+
+func TestPublicAPIDatabaseUnavailable(t *testing.T) {
+	// Point the MongoDB store at an address where nothing listens
+	defer func(previous AdStore, config Config, conn *ConnectionManager) {
+		adStore, cfg, mongoConn = previous, config, conn
+	}(adStore, cfg, mongoConn)
+	cfg.MongoURI = "mongodb://127.0.0.1:1"
+	cfg.ConnectTimeout = Duration(100 * time.Millisecond)
+	mongoConn = NewConnectionManager()
+	assert.Error(t, mongoConn.Connect())
+	assert.Equal(t, Disconnected, mongoConn.Status().State)
+	adStore = NewMongoAdStore()
+
+	router := gin.Default()
+	router.GET("/api/v1/ad", getAds)
+
+	req, err := http.NewRequest("GET", "/api/v1/ad?age=24", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"error": {"status": 503, "code": "DB_UNAVAILABLE", "message": "Failed to connect to database"}}`, rr.Body.String())
+
+	// So are operations on a client closed after a reconnection
+	adStore = closedAdStore{}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+}
+
+// closedAdStore is an AdStore whose searches run on a disconnected client.
+type closedAdStore struct {
+	AdStore
+}
+
+func (closedAdStore) FindActiveAds(ctx context.Context, now time.Time, query AdQuery, page Page) ([]AdItem, error) {
+	return nil, fmt.Errorf("find: %w", mongo.ErrClientDisconnected)
+}
+
+// slowAdStore is an AdStore whose searches only return when their context is done.
+type slowAdStore struct {
+	AdStore
+}
+
+func (slowAdStore) FindActiveAds(ctx context.Context, now time.Time, query AdQuery, page Page) ([]AdItem, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestRequestDeadline(t *testing.T) {
+	defer func(previous AdStore, config Config) { adStore, cfg = previous, config }(adStore, cfg)
+	cfg.RequestTimeout = Duration(20 * time.Millisecond)
+	router := newRouter()
+
+	// A slow search is abandoned at the deadline
+	store := adStore
+	adStore = slowAdStore{store}
+	req, _ := http.NewRequest("GET", "/api/v1/ad", nil)
+	rr := httptest.NewRecorder()
+	start := time.Now()
+	router.ServeHTTP(rr, req)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"code": "DEADLINE_EXCEEDED"`)
+
+	// A request canceled by its client does not reach the store
+	adStore = store
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ = http.NewRequestWithContext(ctx, "GET", "/api/v1/ad", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, statusClientClosedRequest, rr.Code)
+	assert.Empty(t, rr.Body.String())
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	router := gin.Default()
+	router.GET("/healthz", getHealthz)
+	router.GET("/readyz", getReadyz)
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve("/healthz")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"status": "ok"}`, rr.Body.String())
+
+	rr = serve("/readyz")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{
+		"status": "ok",
+		"checks": {
+			"config": {"status": "ok"},
+			"database": {"status": "ok", "detail": "in-memory store"},
+			"indexes": {"status": "ok", "detail": "in-memory store"}
+		}
+	}`, rr.Body.String())
+
+	// With MongoDB unreachable the server is alive but not ready
+	defer func(previous AdStore, config Config, conn *ConnectionManager) {
+		adStore, cfg, mongoConn = previous, config, conn
+	}(adStore, cfg, mongoConn)
+	cfg.MongoURI = "mongodb://127.0.0.1:1"
+	cfg.ConnectTimeout = Duration(100 * time.Millisecond)
+	mongoConn = NewConnectionManager()
+	mongoConn.Connect()
+	adStore = NewMongoAdStore()
+
+	rr = serve("/healthz")
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = serve("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	var report HealthReport
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &report))
+	assert.Equal(t, "unavailable", report.Status)
+	assert.Equal(t, "ok", report.Checks["config"].Status)
+	assert.Equal(t, "unavailable", report.Checks["database"].Status)
+	assert.Contains(t, report.Checks["database"].Detail, "disconnected")
+	assert.Equal(t, CheckResult{Status: "unavailable", Detail: "database unavailable"}, report.Checks["indexes"])
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	backoff := 500 * time.Millisecond
+	var delays []time.Duration
+	for i := 0; i < 5; i++ {
+		delays = append(delays, backoff)
+		backoff = nextBackoff(backoff, 3*time.Second)
+	}
+	assert.Equal(t, []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second}, delays)
+
+	for i := 0; i < 100; i++ {
+		d := jitter(time.Second)
+		assert.True(t, d > 800*time.Millisecond && d <= time.Second, d)
+	}
+}
+
+func TestPingFailures(t *testing.T) {
+	defer func(config Config) { cfg = config }(cfg)
+	cfg.ConnectTimeout = Duration(50 * time.Millisecond)
+	// Nothing listens on port 1, and connecting does not reach the server
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://127.0.0.1:1").SetServerSelectionTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(context.Background())
+	m := NewConnectionManager()
+	m.client, m.state = client, Connected
+
+	// A single failed ping does not drop the connection
+	for i := 1; i < maxPingFailures; i++ {
+		m.ping()
+		assert.Equal(t, Connected, m.Status().State)
+	}
+	m.ping()
+	assert.Equal(t, Disconnected, m.Status().State)
+	assert.Error(t, m.Status().LastError)
+	// The client stays open for pending operations until replaced
+	assert.Same(t, client, m.client)
+	assert.NotErrorIs(t, client.Ping(context.Background(), nil), mongo.ErrClientDisconnected)
+}
+
+func TestAdWatcherErrors(t *testing.T) {
+	assert.True(t, isChangeStreamUnsupported(fmt.Errorf("watch: %w", mongo.CommandError{Code: changeStreamUnsupportedCode})))
+	assert.False(t, isChangeStreamUnsupported(mongo.CommandError{Code: changeStreamHistoryLostCode}))
+	assert.False(t, isChangeStreamUnsupported(ErrStoreUnavailable))
+	assert.True(t, isChangeStreamHistoryLost(mongo.CommandError{Code: changeStreamHistoryLostCode}))
+}
+
+// connectTestMongo points mongoConn at the MongoDB deployment of MONGO_TEST_URI,
+// in a database dropped after the test. The test is skipped when none is reachable.
+func connectTestMongo(t *testing.T) {
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI is not set")
+	}
+	previousCfg, previousConn := cfg, mongoConn
+	cfg.MongoURI = uri
+	cfg.DBName = "test_api_" + primitive.NewObjectID().Hex()
+	cfg.ConnectTimeout = Duration(2 * time.Second)
+	mongoConn = NewConnectionManager()
+	if err := mongoConn.Connect(); err != nil {
+		cfg, mongoConn = previousCfg, previousConn
+		t.Skipf("MongoDB is not reachable: %v", err)
+	}
+	t.Cleanup(func() {
+		if client, err := mongoConn.Client(); err == nil {
+			client.Database(cfg.DBName).Drop(context.Background())
+		}
+		mongoConn.Close(context.Background())
+		cfg, mongoConn = previousCfg, previousConn
+	})
+}
+
+func TestAdWatcherPollSeesDeletes(t *testing.T) {
+	connectTestMongo(t)
+	cfg.WatchPollInterval = Duration(20 * time.Millisecond)
+	ctx := context.Background()
+	store := NewMongoAdStore()
+	id, err := store.InsertAd(ctx, Advertisement{Title: "deleted by another instance"})
+	assert.NoError(t, err)
+
+	changes := make(chan struct{}, 1)
+	watcher := NewAdWatcher(func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	})
+	watcher.instance = "poller"
+	done := make(chan error, 1)
+	go func() { done <- watcher.poll() }()
+	defer func() {
+		watcher.cancel()
+		<-done
+	}()
+
+	// The poller starts from the current revision
+	client, _ := mongoConn.Client()
+	states := client.Database(cfg.DBName).Collection(cfg.WatchStateCollectionName)
+	assert.Eventually(t, func() bool {
+		n, _ := states.CountDocuments(ctx, bson.M{"_id": "poller"})
+		return n == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, store.DeleteAd(ctx, id))
+	select {
+	case <-changes:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the deletion was not seen by polling")
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	closed := false
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(ctx, newServer(handler), ln, func(context.Context) error {
+			closed = true
+			return nil
+		})
+	}()
+
+	// Shut down while a request is in flight
+	response := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			response <- 0
+			return
+		}
+		resp.Body.Close()
+		response <- resp.StatusCode
+	}()
+	<-started
+	cancel()
+
+	assert.Equal(t, http.StatusOK, <-response)
+	assert.NoError(t, <-done)
+	assert.True(t, closed)
+}
+
+func TestStructuredLogging(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	var buf bytes.Buffer
+	assert.NoError(t, setupLogging(&buf, "info"))
+	assert.Error(t, setupLogging(&buf, "verbose"))
+	router := newRouter()
+
+	serve := func(path, id string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("X-Request-ID", id)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	lines := func() []map[string]interface{} {
+		var entries []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var entry map[string]interface{}
+			assert.NoError(t, json.Unmarshal([]byte(line), &entry), line)
+			entries = append(entries, entry)
+		}
+		buf.Reset()
+		return entries
+	}
+
+	// Every line of a request carries its ID, and the search logs its parameters and result size
+	rr := serve("/api/v1/ad?age=25&country=JP&limit=5", "search-1")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	entries := lines()
+	assert.Len(t, entries, 2)
+	for _, entry := range entries {
+		assert.Equal(t, "search-1", entry["requestId"])
+	}
+	assert.Equal(t, "searched ads", entries[0]["msg"])
+	assert.Equal(t, "25", entries[0]["age"])
+	assert.Equal(t, "JP", entries[0]["country"])
+	assert.Equal(t, float64(5), entries[0]["limit"])
+	assert.Equal(t, float64(1), entries[0]["matched"])
+	assert.Equal(t, "request", entries[1]["msg"])
+	assert.Equal(t, "/api/v1/ad", entries[1]["route"])
+	assert.Equal(t, float64(200), entries[1]["status"])
+
+	// Error responses carry the same ID as the log lines
+	rr = serve("/api/v1/ad?age=old", "bad-age-1")
+	assert.Contains(t, rr.Body.String(), `"requestId": "bad-age-1"`)
+	entries = lines()
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "bad-age-1", entries[0]["requestId"])
+	assert.Equal(t, float64(400), entries[0]["status"])
+
+	// Messages below the level are dropped
+	assert.NoError(t, setupLogging(&buf, "warn"))
+	router = newRouter()
+	serve("/api/v1/ad", "quiet-1")
+	assert.Empty(t, buf.String())
+}
+
+func TestMetrics(t *testing.T) {
+	router := newRouter()
+	for _, path := range []string{"/api/v1/ad?country=JP", "/api/v1/unknown"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// MongoDB commands and pool events are recorded from the driver monitors
+	failures := testutil.ToFloat64(mongoCommandErrors.WithLabelValues("find"))
+	mongoCommandMonitor.Failed(context.Background(), &event.CommandFailedEvent{
+		CommandFinishedEvent: event.CommandFinishedEvent{CommandName: "find", Duration: time.Millisecond},
+	})
+	assert.Equal(t, failures+1, testutil.ToFloat64(mongoCommandErrors.WithLabelValues("find")))
+	inUse := testutil.ToFloat64(mongoPoolInUse)
+	mongoPoolMonitor.Event(&event.PoolEvent{Type: event.GetSucceeded})
+	assert.Equal(t, inUse+1, testutil.ToFloat64(mongoPoolInUse))
+	mongoPoolMonitor.Event(&event.PoolEvent{Type: event.ConnectionReturned})
+
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	body := rr.Body.String()
+	assert.Contains(t, body, `http_requests_total{method="GET",route="/api/v1/ad",status="200"}`)
+	assert.Contains(t, body, `http_requests_total{method="GET",route="",status="404"}`)
+	assert.Contains(t, body, `http_request_duration_seconds_bucket{method="GET",route="/api/v1/ad",status="200",le="0.005"}`)
+	assert.Contains(t, body, `mongo_command_duration_seconds_count{command="find"}`)
+	assert.Contains(t, body, "ads_public_result_size_count")
+	assert.Regexp(t, `(?m)^ads_active \d+$`, body)
+}
+
+func TestMemoryAdStoreMatching(t *testing.T) {
+	store := NewMemoryAdStore()
+	now, _ := ParseTime("2024-01-01T00:00:00.000Z")
+
+	store.InsertAd(context.Background(), Advertisement{Title: "any", StartAt: now.AddDate(0, -1, 0), EndAt: now.AddDate(0, 1, 0), Conditions: []Condition{
+		{AgeStart: 1, AgeEnd: 100},
+	}})
+	store.InsertAd(context.Background(), Advertisement{Title: "empty country", StartAt: now.AddDate(0, -1, 0), EndAt: now.AddDate(0, 1, 0), Conditions: []Condition{
+		{AgeStart: 1, AgeEnd: 100, Country: []Country{}},
+	}})
+	store.InsertAd(context.Background(), Advertisement{Title: "second condition", StartAt: now.AddDate(0, -1, 0), EndAt: now.AddDate(0, 1, 0), Conditions: []Condition{
+		{AgeStart: 10, AgeEnd: 20, Platform: []Platform{"web"}},
+		{AgeStart: 30, AgeEnd: 40, Platform: []Platform{"ios"}},
+	}})
+	store.InsertAd(context.Background(), Advertisement{Title: "no conditions", StartAt: now.AddDate(0, -1, 0), EndAt: now.AddDate(0, 1, 0)})
+	store.InsertAd(context.Background(), Advertisement{Title: "expired", StartAt: now.AddDate(0, -2, 0), EndAt: now.AddDate(0, -1, 0), Conditions: []Condition{
+		{AgeStart: 1, AgeEnd: 100},
+	}})
+
+	titles := func(query AdQuery) []string {
+		items, err := store.FindActiveAds(context.Background(), now, query, Page{Limit: -1})
+		assert.NoError(t, err)
+		result := []string{}
+		for _, item := range items {
+			result = append(result, item.Title)
+		}
+		return result
+	}
+
+	age := 35
+	assert.Equal(t, []string{"any", "empty country", "second condition"}, titles(AdQuery{}))
+	assert.Equal(t, []string{"any", "second condition"}, titles(AdQuery{Country: "TW"}))
+	assert.Equal(t, []string{"any", "empty country", "second condition"}, titles(AdQuery{Age: &age, Platform: "ios"}))
+	assert.Equal(t, []string{"any", "empty country"}, titles(AdQuery{Age: &age, Platform: "web"}))
+}
+
+func TestMemoryAdStoreCRUD(t *testing.T) {
+	store := NewMemoryAdStore()
+
+	id, err := store.InsertAd(context.Background(), Advertisement{Title: "first"})
+	assert.NoError(t, err)
+
+	ad, err := store.GetAd(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", ad.Title)
+
+	assert.NoError(t, store.UpdateAd(context.Background(), id, Advertisement{Title: "second"}))
+	ad, _ = store.GetAd(context.Background(), id)
+	assert.Equal(t, "second", ad.Title)
+
+	// Stored ads share no memory with the ads given or returned
+	conditions := []Condition{{AgeStart: 1, AgeEnd: 100, Gender: []Gender{"M"}}}
+	assert.NoError(t, store.UpdateAd(context.Background(), id, Advertisement{Title: "third", Conditions: conditions}))
+	conditions[0].Gender[0] = "F"
+	ad, _ = store.GetAd(context.Background(), id)
+	ad.Conditions[0].AgeEnd = 50
+	ad, _ = store.GetAd(context.Background(), id)
+	assert.Equal(t, []Condition{{AgeStart: 1, AgeEnd: 100, Gender: []Gender{"M"}}}, ad.Conditions)
+
+	assert.NoError(t, store.DeleteAd(context.Background(), id))
+	_, err = store.GetAd(context.Background(), id)
+	assert.ErrorIs(t, err, ErrAdNotFound)
+	assert.ErrorIs(t, store.DeleteAd(context.Background(), id), ErrAdNotFound)
+	assert.ErrorIs(t, store.UpdateAd(context.Background(), "not-an-id", Advertisement{}), ErrInvalidID)
+}
+
+// matchingTestAds returns active, upcoming and expired ads around now, pending or
+// not, with conditions covering every combination of unset, empty and set lists.
+func matchingTestAds(now time.Time) []Advertisement {
+	genders := [][]Gender{nil, {}, {Male}, {Male, Female}}
+	countries := [][]Country{nil, {Japan}, {Taiwan, Korea}}
+	platforms := [][]Platform{nil, {IOS}, {Android, Web}}
+	regions := [][]Region{nil, {"JP-13"}, {"JP-27", "KR-11"}, nil}
+	cities := [][]City{nil, {"tokyo"}}
+	statuses := []AdStatus{"", AdApproved, AdPending}
+	var ads []Advertisement
+	for i := 0; i < 60; i++ {
+		// Some ads share endAt
+		start := now.Add(time.Duration(i%5-3) * time.Hour)
+		end := now.Add(time.Duration(i%7-1) * time.Hour)
+		if !start.Before(end) {
+			end = start.Add(time.Hour)
+		}
+		var conds []Condition
+		for j := 0; j < i%3; j++ {
+			conds = append(conds, Condition{
+				AgeStart: 10 * (i % 4), AgeEnd: 10*(i%4) + 15 + 5*j,
+				Gender:   genders[(i+j)%len(genders)],
+				Country:  countries[(i+2*j)%len(countries)],
+				Region:   regions[(i/3+j)%len(regions)],
+				City:     cities[(i/5)%len(cities)],
+				Platform: platforms[(i/2+j)%len(platforms)],
+			})
+		}
+		ads = append(ads, Advertisement{ID: primitive.NewObjectID(), Title: "Ad " + strconv.Itoa(i), StartAt: start, EndAt: end, Conditions: conds, Status: statuses[(i/4)%len(statuses)]})
+	}
+	return ads
+}
+
+// matchingTestQueries returns searches over every targeting parameter.
+func matchingTestQueries() []AdQuery {
+	ages := []int{-1, 0, 10, 15, 25, 44, 60, 101}
+	var queries []AdQuery
+	for _, age := range ages {
+		for _, gender := range []Gender{"", Male, Female} {
+			for _, country := range []Country{"", Japan, Korea, Thailand} {
+				for _, platform := range []Platform{"", IOS, Web} {
+					queries = append(queries, AdQuery{Age: &age, Gender: gender, Country: country, Platform: platform})
+				}
+			}
+			for _, region := range []Region{"JP-13", "KR-11"} {
+				for _, city := range []City{"", "tokyo"} {
+					queries = append(queries, AdQuery{Age: &age, Gender: gender, Country: region.Country(), Region: region, City: city})
+				}
+			}
+		}
+	}
+	return append(queries, AdQuery{})
+}
+
+// assertSameSearches asserts that actual finds the same ads as expected for every
+// query, with offset and cursor pagination.
+func assertSameSearches(t *testing.T, expected, actual AdStore, now time.Time) {
+	for _, query := range matchingTestQueries() {
+		all, _ := expected.FindActiveAds(context.Background(), now, query, Page{Limit: -1})
+		pages := []Page{{Limit: -1}, {Limit: 0}, {Offset: 2, Limit: 3}, {Offset: 100, Limit: -1}}
+		if len(all) > 1 {
+			after := PageCursor{EndAt: all[1].EndAt, ID: all[1].ID}
+			pages = append(pages, Page{After: &after, Limit: 2})
+		}
+		for _, page := range pages {
+			expectedItems, err := expected.FindActiveAds(context.Background(), now, query, page)
+			assert.NoError(t, err)
+			actualItems, err := actual.FindActiveAds(context.Background(), now, query, page)
+			assert.NoError(t, err)
+			expectedJSON, _ := json.Marshal(expectedItems)
+			actualJSON, _ := json.Marshal(actualItems)
+			assert.Equal(t, string(expectedJSON), string(actualJSON), "query %+v page %+v", query, page)
+		}
+	}
+}
+
+func TestServingIndexMatchesStore(t *testing.T) {
+	store := NewMemoryAdStore()
+	// Search a minute after the build; some ads end exactly then, which is still active
+	now := time.Now().Add(time.Minute).Truncate(time.Millisecond)
+	for _, ad := range matchingTestAds(now) {
+		store.InsertAd(context.Background(), ad)
+	}
+
+	indexed := NewIndexedAdStore(store, time.Minute)
+	assert.NoError(t, indexed.Rebuild(context.Background()))
+	assertSameSearches(t, store, indexed, now)
+}
+
+func TestMongoAdStoreMatchesMemory(t *testing.T) {
+	connectTestMongo(t)
+	memory := NewMemoryAdStore()
+	store := NewMongoAdStore()
+	now := time.Now().Truncate(time.Millisecond)
+	for _, ad := range matchingTestAds(now) {
+		memory.InsertAd(context.Background(), ad)
+		_, err := store.InsertAd(context.Background(), ad)
+		assert.NoError(t, err)
+	}
+
+	assertSameSearches(t, memory, store, now)
+	for _, query := range matchingTestQueries() {
+		expected, err := memory.NextChange(context.Background(), now, query)
+		assert.NoError(t, err)
+		actual, err := store.NextChange(context.Background(), now, query)
+		assert.NoError(t, err)
+		assert.True(t, expected.Equal(actual), "query %+v: %v, not %v", query, actual, expected)
+	}
+	expected, _ := memory.CountActiveAds(context.Background(), now)
+	count, err := store.CountActiveAds(context.Background(), now)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, count)
+}
+
+func TestMongoAdStoreInsertAds(t *testing.T) {
+	connectTestMongo(t)
+	cfg.BulkBatchSize = 2
+	store := NewMongoAdStore()
+	ctx := context.Background()
+	existing := primitive.NewObjectID()
+	_, err := store.InsertAd(ctx, Advertisement{ID: existing, Title: "existing"})
+	assert.NoError(t, err)
+	count := func() int64 {
+		col, _ := mongoConn.Collection()
+		n, err := col.CountDocuments(ctx, bson.M{})
+		assert.NoError(t, err)
+		return n
+	}
+
+	// A transaction stores every ad or none, when the deployment supports it
+	ads := []Advertisement{{Title: "first"}, {Title: "second"}, {ID: existing, Title: "duplicate"}}
+	ids, err := store.InsertAds(ctx, ads, true)
+	if !errors.Is(err, ErrAtomicUnsupported) {
+		assert.ErrorIs(t, err, ErrAdConflict)
+	}
+	assert.Nil(t, ids)
+	assert.Equal(t, int64(1), count())
+
+	// Otherwise the ads of every batch are stored despite the failure of one
+	ads = []Advertisement{{Title: "first"}, {ID: existing, Title: "duplicate"}, {Title: "third"}}
+	ids, err = store.InsertAds(ctx, ads, false)
+	var writeErr mongo.BulkWriteException
+	assert.ErrorAs(t, err, &writeErr)
+	assert.Len(t, ids, 3)
+	assert.NotEmpty(t, ids[0])
+	assert.Empty(t, ids[1])
+	assert.NotEmpty(t, ids[2])
+	assert.Equal(t, int64(3), count())
+	ad, err := store.GetAd(ctx, ids[2])
+	assert.NoError(t, err)
+	assert.Equal(t, "third", ad.Title)
+}
+
+func TestIndexedAdStoreRebuildsOnWrite(t *testing.T) {
+	store := NewMemoryAdStore()
+	indexed := NewIndexedAdStore(store, time.Hour)
+	now := time.Now()
+	titles := func() []string {
+		items, _ := indexed.FindActiveAds(context.Background(), now, AdQuery{}, Page{Limit: -1})
+		result := []string{}
+		for _, item := range items {
+			result = append(result, item.Title)
+		}
+		return result
+	}
+
+	// Searches use the store until the index is built
+	store.InsertAd(context.Background(), Advertisement{Title: "first", StartAt: now.Add(-time.Hour), EndAt: now.Add(time.Hour), Conditions: []Condition{{AgeStart: 1, AgeEnd: 100}}})
+	assert.Equal(t, []string{"first"}, titles())
+
+	indexed.Start()
+	defer indexed.Close(context.Background())
+	assert.Eventually(t, func() bool { return indexed.index.Load() != nil }, time.Second, 5*time.Millisecond)
+
+	// Writes to the store alone are not seen until a rebuild
+	store.InsertAd(context.Background(), Advertisement{Title: "hidden", StartAt: now.Add(-time.Hour), EndAt: now.Add(time.Hour), Conditions: []Condition{{AgeStart: 1, AgeEnd: 100}}})
+	assert.Equal(t, []string{"first"}, titles())
+
+	id, err := indexed.InsertAd(context.Background(), Advertisement{Title: "second", StartAt: now.Add(-time.Hour), EndAt: now.Add(2 * time.Hour), Conditions: []Condition{{AgeStart: 1, AgeEnd: 100}}})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return slices.Equal(titles(), []string{"first", "hidden", "second"}) }, time.Second, 5*time.Millisecond)
+
+	assert.NoError(t, indexed.DeleteAd(context.Background(), id))
+	assert.Eventually(t, func() bool { return slices.Equal(titles(), []string{"first", "hidden"}) }, time.Second, 5*time.Millisecond)
+
+	// Pending ads are served once approved
+	id, err = indexed.InsertAd(context.Background(), Advertisement{Title: "pending", Status: AdPending, StartAt: now.Add(-time.Hour), EndAt: now.Add(2 * time.Hour), Conditions: []Condition{{AgeStart: 1, AgeEnd: 100}}})
+	assert.NoError(t, err)
+	assert.NoError(t, indexed.Rebuild(context.Background()))
+	assert.Equal(t, []string{"first", "hidden"}, titles())
+	assert.NoError(t, indexed.ApproveAd(context.Background(), id))
+	assert.Eventually(t, func() bool { return slices.Equal(titles(), []string{"first", "hidden", "pending"}) }, time.Second, 5*time.Millisecond)
+}
+
+// slowLiveAdStore takes delay to list the live ads.
+type slowLiveAdStore struct {
+	AdStore
+	delay time.Duration
+}
+
+func (s slowLiveAdStore) FindLiveAds(ctx context.Context, now time.Time) ([]Advertisement, error) {
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return s.AdStore.FindLiveAds(ctx, now)
+}
+
+func TestIndexedAdStoreSlowRebuild(t *testing.T) {
+	// A rebuild longer than the refresh interval still completes
+	indexed := NewIndexedAdStore(slowLiveAdStore{NewMemoryAdStore(), 50 * time.Millisecond}, 10*time.Millisecond)
+	indexed.Start()
+	assert.Eventually(t, func() bool { return indexed.index.Load() != nil }, time.Second, 5*time.Millisecond)
+	assert.NoError(t, indexed.Close(context.Background()))
+
+	// Close cancels a rebuild in progress
+	indexed = NewIndexedAdStore(slowLiveAdStore{NewMemoryAdStore(), time.Hour}, 10*time.Millisecond)
+	indexed.Start()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, indexed.Close(ctx))
+	assert.Nil(t, indexed.index.Load())
+}
+
+func TestNextChange(t *testing.T) {
+	store := NewMemoryAdStore()
+	now := time.Now().Truncate(time.Millisecond)
+	webOnly := []Condition{{AgeStart: 1, AgeEnd: 100, Platform: []Platform{Web}}}
+	anyPlatform := []Condition{{AgeStart: 1, AgeEnd: 100}}
+	store.InsertAd(context.Background(), Advertisement{Title: "ends", StartAt: now.Add(-time.Hour), EndAt: now.Add(3 * time.Hour), Conditions: anyPlatform})
+	store.InsertAd(context.Background(), Advertisement{Title: "starts", StartAt: now.Add(2 * time.Hour), EndAt: now.Add(4 * time.Hour), Conditions: anyPlatform})
+	store.InsertAd(context.Background(), Advertisement{Title: "web", StartAt: now.Add(-time.Hour), EndAt: now.Add(time.Hour), Conditions: webOnly})
+	store.InsertAd(context.Background(), Advertisement{Title: "expired", StartAt: now.Add(-2 * time.Hour), EndAt: now.Add(-time.Hour), Conditions: anyPlatform})
+	indexed := NewIndexedAdStore(store, time.Minute)
+	assert.NoError(t, indexed.Rebuild(context.Background()))
+
+	tests := []struct {
+		query    AdQuery
+		expected time.Time
+	}{
+		{AdQuery{}, now.Add(time.Hour + time.Millisecond)},
+		{AdQuery{Platform: IOS}, now.Add(2 * time.Hour)},
+		{AdQuery{Country: Japan, Platform: Web}, now.Add(time.Hour + time.Millisecond)},
+		{AdQuery{Age: new(int)}, time.Time{}},
+	}
+	for _, test := range tests {
+		for _, s := range []AdStore{store, indexed} {
+			next, err := s.NextChange(context.Background(), now, test.query)
+			assert.NoError(t, err)
+			assert.True(t, test.expected.Equal(next), "%T %+v: %v", s, test.query, next)
+		}
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	cache := NewResponseCache(2, time.Hour)
+	now := time.Now()
+	hits := testutil.ToFloat64(responseCacheRequests.WithLabelValues("hit"))
+	misses := testutil.ToFloat64(responseCacheRequests.WithLabelValues("miss"))
+
+	// Equal queries share an entry, which expires at the next ad boundary
+	age := 25
+	key := responseCacheKey(AdQuery{Age: &age, Country: Japan}, Page{Limit: -1})
+	other := 25
+	assert.Equal(t, key, responseCacheKey(AdQuery{Age: &other, Country: Japan}, Page{Limit: -1}))
+	assert.NotEqual(t, key, responseCacheKey(AdQuery{Age: &age, Country: Japan}, Page{Limit: 10}))
+	_, generation, ok := cache.Get(key, now)
+	assert.False(t, ok)
+	cache.Set(key, generation, DisplayAds{Items: []AdItem{{Title: "cached"}}}, now, now.Add(time.Minute))
+	ads, _, ok := cache.Get(key, now.Add(time.Minute-time.Millisecond))
+	assert.True(t, ok)
+	assert.Equal(t, "cached", ads.Items[0].Title)
+	_, _, ok = cache.Get(key, now.Add(time.Minute))
+	assert.False(t, ok)
+
+	// Without a boundary, entries are kept for the TTL
+	_, generation, _ = cache.Get(key, now)
+	cache.Set(key, generation, DisplayAds{}, now, time.Time{})
+	_, _, ok = cache.Get(key, now.Add(time.Hour-time.Millisecond))
+	assert.True(t, ok)
+
+	// Responses computed before a Clear are not cached
+	_, generation, _ = cache.Get("other", now)
+	cache.Clear()
+	cache.Set("other", generation, DisplayAds{}, now, time.Time{})
+	_, _, ok = cache.Get("other", now)
+	assert.False(t, ok)
+	_, _, ok = cache.Get(key, now)
+	assert.False(t, ok)
+
+	assert.Equal(t, hits+2, testutil.ToFloat64(responseCacheRequests.WithLabelValues("hit")))
+	assert.Equal(t, misses+6, testutil.ToFloat64(responseCacheRequests.WithLabelValues("miss")))
+
+	// A nil cache caches nothing
+	var disabled *ResponseCache
+	disabled.Set(key, 0, DisplayAds{}, now, time.Time{})
+	_, _, ok = disabled.Get(key, now)
+	assert.False(t, ok)
+}
+
+func TestPublicAPIResponseCache(t *testing.T) {
+	defer func(previous AdStore, cache *ResponseCache) { adStore, adCache = previous, cache }(adStore, adCache)
+	adStore = NewMemoryAdStore()
+	adCache = NewResponseCache(10, time.Hour)
+	router := gin.Default()
+	router.GET("/api/v1/ad", getAds)
+	router.POST("/api/v1/ad", addAds)
+	router.POST("/api/v1/ad/:id/approve", approveAd)
+
+	search := func(query string) string {
+		req, _ := http.NewRequest("GET", "/api/v1/ad"+query, nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		return rr.Body.String()
+	}
+	hits := testutil.ToFloat64(responseCacheRequests.WithLabelValues("hit"))
+
+	first := search("?country=JP&age=30")
+	assert.Equal(t, first, search("?age=030&country=JP"))
+	assert.Equal(t, hits+1, testutil.ToFloat64(responseCacheRequests.WithLabelValues("hit")))
+
+	// New ads are pending, even when the body claims otherwise
+	payload := []byte(`{"title": "New", "status": "approved", "startAt": "2023-01-01T00:00:00.000Z", "endAt": "2099-01-01T00:00:00.000Z", "conditions": [{"ageStart": 1, "ageEnd": 100}]}`)
+	req, _ := http.NewRequest("POST", "/api/v1/ad", bytes.NewBuffer(payload))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	var created Advertisement
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &created))
+	assert.Equal(t, AdPending, created.Status)
+	assert.Equal(t, first, search("?country=JP&age=30"))
+
+	// Approving an ad drops the cached responses
+	req, _ = http.NewRequest("POST", "/api/v1/ad/"+created.ID.Hex()+"/approve", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"status": "approved"`)
+	assert.Contains(t, search("?country=JP&age=30"), `"title": "New"`)
+}
+
+func TestDiffIndexes(t *testing.T) {
+	existing := []IndexSpec{
+		{Name: "_id_", Keys: bson.D{{Key: "_id", Value: int32(1)}}},
+		{Name: "startAt_1_endAt_1", Keys: bson.D{{Key: "startAt", Value: int32(1)}, {Key: "endAt", Value: int32(1)}}},
+		{Name: "endAt_1__id_1", Keys: bson.D{{Key: "endAt", Value: int32(-1)}, {Key: "_id", Value: int32(1)}}},
+		{Name: "title_1", Keys: bson.D{{Key: "title", Value: int32(1)}}},
+	}
+
+	drift := diffIndexes(expectedIndexes, existing)
+	assert.False(t, drift.IsEmpty())
+	assert.Equal(t, []string{"conditions.country_1", "conditions.region_1", "conditions.city_1", "conditions.platform_1", "conditions.gender_1", "conditions.ageStart_1_conditions.ageEnd_1"}, drift.Missing)
+	assert.Equal(t, []string{"endAt_1__id_1"}, drift.Changed)
+	assert.Equal(t, []string{"title_1"}, drift.Unexpected)
+
+	assert.True(t, diffIndexes(expectedIndexes, expectedIndexes).IsEmpty())
+}
+
+func TestEnsureIndexesRecreatesChanged(t *testing.T) {
+	connectTestMongo(t)
+	ctx := context.Background()
+	store := NewMongoAdStore()
+	col, _ := mongoConn.Collection()
+	_, err := col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "endAt", Value: -1}, {Key: "_id", Value: 1}},
+		Options: options.Index().SetName("endAt_1__id_1"),
+	})
+	assert.NoError(t, err)
+	drift, err := store.VerifyIndexes(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"endAt_1__id_1"}, drift.Changed)
+
+	assert.NoError(t, store.EnsureIndexes(ctx))
+	drift, err = store.VerifyIndexes(ctx)
+	assert.NoError(t, err)
+	assert.True(t, drift.IsEmpty(), "%+v", drift)
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	err := os.WriteFile(path, []byte("listenAddr: \":9090\"\ndbName: file_db\ncollectionName: file_ads\nconnectTimeout: 3s\n"), 0o600)
+	assert.NoError(t, err)
+
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("DB_NAME", "env_db")
+
+	config, args, err := LoadConfig([]string{"-collection-name", "flag_ads", "indexes", "verify"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"indexes", "verify"}, args)
+	assert.Equal(t, ":9090", config.ListenAddr)
+	assert.Equal(t, "env_db", config.DBName)
+	assert.Equal(t, "flag_ads", config.CollectionName)
+	assert.Equal(t, Duration(3*time.Second), config.ConnectTimeout)
+	assert.Equal(t, "mongodb://localhost:27017", config.MongoURI)
+	assert.Equal(t, uint64(100), config.MaxPoolSize)
+	assert.Equal(t, RateLimit{Rate: 10, Burst: 20}, config.RateLimits[publicAdRoute])
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	t.Setenv("AD_STORE", "redis")
+	_, _, err := LoadConfig(nil)
+	assert.ErrorContains(t, err, `store must be "mongo" or "memory"`)
+
+	t.Setenv("AD_STORE", "mongo")
+	_, _, err = LoadConfig([]string{"-mongo-max-pool-size", "0", "-db-name", ""})
+	assert.ErrorContains(t, err, "maxPoolSize must be positive")
+	assert.ErrorContains(t, err, "dbName must be set")
+
+	t.Setenv("RATE_LIMIT_STORE", "redis")
+	t.Setenv("PUBLIC_RATE_LIMIT_RATE", "0")
+	_, _, err = LoadConfig(nil)
+	assert.ErrorContains(t, err, `rateLimitStore must be "memory" or "mongo"`)
+	assert.ErrorContains(t, err, `rateLimits "GET /api/v1/ad" must have a positive rate and burst`)
+
+	t.Setenv("WATCH_MODE", "tail")
+	_, _, err = LoadConfig(nil)
+	assert.ErrorContains(t, err, `watchMode must be "auto", "changestream", "poll" or "off", got "tail"`)
+
+	t.Setenv("LOG_LEVEL", "verbose")
+	_, _, err = LoadConfig(nil)
+	assert.ErrorContains(t, err, `logLevel must be debug, info, warn or error, got "verbose"`)
+
+	t.Setenv("MONGO_CONNECT_TIMEOUT", "soon")
+	_, _, err = LoadConfig(nil)
+	assert.ErrorContains(t, err, "invalid MONGO_CONNECT_TIMEOUT")
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MemoryAdStore is an AdStore that keeps ads in process memory.
+// It reproduces the matching semantics of the MongoDB query built by buildAdFilter
+// so the API can run without a database.
+type MemoryAdStore struct {
+	mu  sync.RWMutex
+	ids []string
+	ads map[string]Advertisement
+}
+
+// NewMemoryAdStore returns an empty in-memory AdStore.
+func NewMemoryAdStore() *MemoryAdStore {
+	return &MemoryAdStore{ads: map[string]Advertisement{}}
+}
+
+func (s *MemoryAdStore) InsertAd(ctx context.Context, ad Advertisement) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ad.ID.IsZero() {
+		ad.ID = primitive.NewObjectID()
+	}
+	id := ad.ID.Hex()
+	if _, ok := s.ads[id]; ok {
+		return "", ErrAdConflict
+	}
+	s.ids = append(s.ids, id)
+	s.ads[id] = normalizeStoredAd(ad)
+	return id, nil
+}
+
+func (s *MemoryAdStore) InsertAds(ctx context.Context, ads []Advertisement, atomic bool) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]string, len(ads))
+	for i := range ads {
+		if ads[i].ID.IsZero() {
+			ids[i] = primitive.NewObjectID().Hex()
+		} else {
+			ids[i] = ads[i].ID.Hex()
+		}
+		if _, ok := s.ads[ids[i]]; ok && atomic {
+			return nil, ErrAdConflict
+		}
+	}
+
+	var err error
+	for i, ad := range ads {
+		if _, ok := s.ads[ids[i]]; ok {
+			ids[i] = ""
+			err = ErrAdConflict
+			continue
+		}
+		ad.ID, _ = primitive.ObjectIDFromHex(ids[i])
+		s.ids = append(s.ids, ids[i])
+		s.ads[ids[i]] = normalizeStoredAd(ad)
+	}
+	return ids, err
+}
+
+func (s *MemoryAdStore) FindActiveAds(ctx context.Context, now time.Time, query AdQuery, page Page) ([]AdItem, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	now = storedTime(now)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ads := []Advertisement{}
+	for _, id := range s.ids {
+		ad := s.ads[id]
+		if !ad.Approved() || ad.StartAt.After(now) || ad.EndAt.Before(now) {
+			continue
+		}
+		for _, cond := range ad.Conditions {
+			if cond.Matches(query) {
+				ads = append(ads, ad)
+				break
+			}
+		}
+	}
+
+	// Sort by endAt then ID, like the MongoDB store
+	sort.Slice(ads, func(i, j int) bool {
+		return cursorOf(ads[i]).Less(cursorOf(ads[j]))
+	})
+
+	// Skip the results up to the cursor
+	if page.After != nil {
+		ads = slices.DeleteFunc(ads, func(ad Advertisement) bool {
+			return !page.After.Less(cursorOf(ad))
+		})
+	}
+
+	// apply pagination
+	start := min(page.Offset, len(ads))
+	end := len(ads)
+	if page.Limit >= 0 {
+		end = min(start+page.Limit, end)
+	}
+
+	items := []AdItem{}
+	for _, ad := range ads[start:end] {
+		items = append(items, AdItem{ID: ad.ID, Title: ad.Title, EndAt: ad.EndAt})
+	}
+	return items, nil
+}
+
+func (s *MemoryAdStore) NextChange(ctx context.Context, now time.Time, query AdQuery) (time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return time.Time{}, err
+	}
+	now = storedTime(now)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var next time.Time
+	for _, ad := range s.ads {
+		if !ad.Approved() {
+			continue
+		}
+		for _, cond := range ad.Conditions {
+			if cond.Matches(query) {
+				next = earliest(next, nextChange(ad, now))
+				break
+			}
+		}
+	}
+	return next, nil
+}
+
+func (s *MemoryAdStore) FindLiveAds(ctx context.Context, now time.Time) ([]Advertisement, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ads := []Advertisement{}
+	for _, id := range s.ids {
+		if ad := s.ads[id]; !ad.EndAt.Before(now) {
+			ads = append(ads, cloneAd(ad))
+		}
+	}
+	return ads, nil
+}
+
+func (s *MemoryAdStore) CountActiveAds(ctx context.Context, now time.Time) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	now = storedTime(now)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var count int64
+	for _, ad := range s.ads {
+		if ad.Approved() && !ad.StartAt.After(now) && !ad.EndAt.Before(now) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *MemoryAdStore) GetAd(ctx context.Context, id string) (Advertisement, error) {
+	if err := ctx.Err(); err != nil {
+		return Advertisement{}, err
+	}
+	if !primitive.IsValidObjectID(id) {
+		return Advertisement{}, ErrInvalidID
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ad, ok := s.ads[id]
+	if !ok {
+		return Advertisement{}, ErrAdNotFound
+	}
+	return cloneAd(ad), nil
+}
+
+func (s *MemoryAdStore) UpdateAd(ctx context.Context, id string, ad Advertisement) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !primitive.IsValidObjectID(id) {
+		return ErrInvalidID
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.ads[id]; !ok {
+		return ErrAdNotFound
+	}
+	ad.ID, _ = primitive.ObjectIDFromHex(id)
+	s.ads[id] = normalizeStoredAd(ad)
+	return nil
+}
+
+func (s *MemoryAdStore) ApproveAd(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !primitive.IsValidObjectID(id) {
+		return ErrInvalidID
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ad, ok := s.ads[id]
+	if !ok {
+		return ErrAdNotFound
+	}
+	ad.Status = AdApproved
+	s.ads[id] = ad
+	return nil
+}
+
+func (s *MemoryAdStore) DeleteAd(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !primitive.IsValidObjectID(id) {
+		return ErrInvalidID
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.ads[id]; !ok {
+		return ErrAdNotFound
+	}
+	delete(s.ads, id)
+	for i, v := range s.ids {
+		if v == id {
+			s.ids = append(s.ids[:i], s.ids[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// cursorOf returns the sort position of ad in search results.
+func cursorOf(ad Advertisement) PageCursor {
+	return PageCursor{EndAt: ad.EndAt, ID: ad.ID}
+}
+
+// normalizeStoredAd mimics a round trip through MongoDB, which stores
+// datetimes in UTC with millisecond precision and shares no memory with callers.
+func normalizeStoredAd(ad Advertisement) Advertisement {
+	ad = cloneAd(ad)
+	ad.StartAt = storedTime(ad.StartAt)
+	ad.EndAt = storedTime(ad.EndAt)
+	return ad
+}
+
+// cloneAd returns a deep copy of ad, keeping nil lists nil.
+func cloneAd(ad Advertisement) Advertisement {
+	if ad.Conditions == nil {
+		return ad
+	}
+	conditions := make([]Condition, len(ad.Conditions))
+	for i, cond := range ad.Conditions {
+		cond.Gender = slices.Clone(cond.Gender)
+		cond.Country = slices.Clone(cond.Country)
+		cond.Platform = slices.Clone(cond.Platform)
+		cond.Region = slices.Clone(cond.Region)
+		cond.City = slices.Clone(cond.City)
+		conditions[i] = cond
+	}
+	ad.Conditions = conditions
+	return ad
+}
+
+// Matches reports whether the condition satisfies query, following the
+// $elemMatch clause built by buildAdFilter. A nil list matches any value,
+// like a null field in MongoDB, while an empty non-nil list matches nothing.
+func (cond Condition) Matches(query AdQuery) bool {
+	if query.Age != nil && (cond.AgeStart > *query.Age || cond.AgeEnd < *query.Age) {
+		return false
+	}
+	if query.Gender != "" && cond.Gender != nil && !slices.Contains(cond.Gender, query.Gender) {
+		return false
+	}
+	if query.Country != "" && cond.Country != nil && !slices.Contains(cond.Country, query.Country) {
+		return false
+	}
+	if query.Region != "" && cond.Region != nil && !slices.Contains(cond.Region, query.Region) {
+		return false
+	}
+	if query.City != "" && cond.City != nil && !slices.Contains(cond.City, query.City) {
+		return false
+	}
+	if query.Platform != "" && cond.Platform != nil && !slices.Contains(cond.Platform, query.Platform) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// metricsRegistry holds every metric exposed on /metrics.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Number of HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Latency of HTTP requests by route, method and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	mongoCommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mongo_command_duration_seconds",
+		Help:    "Latency of MongoDB commands by command name.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"command"})
+
+	mongoCommandErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongo_command_errors_total",
+		Help: "Number of failed MongoDB commands by command name.",
+	}, []string{"command"})
+
+	mongoPoolOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mongo_pool_connections_open",
+		Help: "Number of open connections in the MongoDB pool.",
+	})
+
+	mongoPoolInUse = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mongo_pool_connections_in_use",
+		Help: "Number of MongoDB connections checked out of the pool.",
+	})
+
+	mongoPoolCheckoutFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mongo_pool_checkout_failures_total",
+		Help: "Number of failures to check a connection out of the MongoDB pool.",
+	})
+
+	publicResultSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ads_public_result_size",
+		Help:    "Number of ads returned by the public ad search.",
+		Buckets: []float64{0, 1, 2, 5, 10, 20, 50, 100, 200, 500},
+	})
+
+	servingIndexSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ads_serving_index_ads",
+		Help: "Number of live ads in the index answering the public ad search.",
+	})
+
+	adChangeEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ads_change_events_total",
+		Help: "Number of changes to the ads collection seen by the watcher, by source.",
+	}, []string{"source"})
+
+	responseCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ads_response_cache_requests_total",
+		Help: "Number of public ad searches looked up in the response cache, by result: hit or miss.",
+	}, []string{"result"})
+
+	geoLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ads_geoip_lookups_total",
+		Help: "Number of client IPs located for public ad searches without a location, by result: found, not_found or error.",
+	}, []string{"result"})
+
+	servingIndexBuilt = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ads_serving_index_last_build_timestamp_seconds",
+		Help: "Unix time of the last successful build of the public ad search index.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+		httpRequestDuration,
+		mongoCommandDuration,
+		mongoCommandErrors,
+		mongoPoolOpen,
+		mongoPoolInUse,
+		mongoPoolCheckoutFailures,
+		publicResultSize,
+		servingIndexSize,
+		servingIndexBuilt,
+		adChangeEvents,
+		responseCacheRequests,
+		geoLookups,
+		activeAdsCollector{},
+	)
+}
+
+// activeAdsDesc describes the number of active ads, counted in the store on each scrape.
+var activeAdsDesc = prometheus.NewDesc("ads_active", "Number of approved ads whose time window contains the current time.", nil, nil)
+
+// activeAdsCollector reports the number of active ads, or nothing while the store is unavailable.
+type activeAdsCollector struct{}
+
+func (activeAdsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeAdsDesc
+}
+
+func (activeAdsCollector) Collect(ch chan<- prometheus.Metric) {
+	if adStore == nil {
+		return
+	}
+	ctx, cancel := withRequestTimeout(context.Background())
+	defer cancel()
+	count, err := adStore.CountActiveAds(ctx, time.Now())
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(activeAdsDesc, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(activeAdsDesc, prometheus.GaugeValue, float64(count))
+}
+
+// metricsHandler serves the metrics in the Prometheus text format.
+var metricsHandler = gin.WrapH(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+// observeRequest records the count and latency of every request.
+// Requests matching no route are grouped under an empty route.
+func observeRequest(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	labels := prometheus.Labels{
+		"route":  c.FullPath(),
+		"method": c.Request.Method,
+		"status": strconv.Itoa(c.Writer.Status()),
+	}
+	httpRequests.With(labels).Inc()
+	httpRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+}
+
+// mongoCommandMonitor records the latency and errors of MongoDB commands.
+var mongoCommandMonitor = &event.CommandMonitor{
+	Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+		mongoCommandDuration.WithLabelValues(e.CommandName).Observe(e.Duration.Seconds())
+	},
+	Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+		mongoCommandDuration.WithLabelValues(e.CommandName).Observe(e.Duration.Seconds())
+		mongoCommandErrors.WithLabelValues(e.CommandName).Inc()
+	},
+}
+
+// mongoPoolMonitor tracks the connections of the MongoDB pool.
+var mongoPoolMonitor = &event.PoolMonitor{
+	Event: func(e *event.PoolEvent) {
+		switch e.Type {
+		case event.ConnectionCreated:
+			mongoPoolOpen.Inc()
+		case event.ConnectionClosed:
+			mongoPoolOpen.Dec()
+		case event.GetSucceeded:
+			mongoPoolInUse.Inc()
+		case event.ConnectionReturned:
+			mongoPoolInUse.Dec()
+		case event.GetFailed:
+			mongoPoolCheckoutFailures.Inc()
+		}
+	},
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// illegalOperationCode is the MongoDB error code of a transaction on a standalone server.
+const illegalOperationCode = 20
+
+// MongoAdStore is an AdStore backed by the MongoDB collection of mongoConn.
+type MongoAdStore struct{}
+
+// NewMongoAdStore returns an AdStore that uses MongoDB.
+func NewMongoAdStore() *MongoAdStore {
+	return &MongoAdStore{}
+}
+
+// collection returns the ads collection, or an error while the database is unavailable.
+func (s *MongoAdStore) collection() (*mongo.Collection, error) {
+	return mongoConn.Collection()
+}
+
+func (s *MongoAdStore) InsertAd(ctx context.Context, ad Advertisement) (string, error) {
+	col, err := s.collection()
+	if err != nil {
+		return "", err
+	}
+	if ad.ID.IsZero() {
+		ad.ID = primitive.NewObjectID()
+	}
+	_, err = col.InsertOne(ctx, ad)
+	if mongo.IsDuplicateKeyError(err) {
+		return "", ErrAdConflict
+	} else if err != nil {
+		return "", err
+	}
+	recordChange(ctx)
+	return ad.ID.Hex(), nil
+}
+
+func (s *MongoAdStore) InsertAds(ctx context.Context, ads []Advertisement, atomic bool) ([]string, error) {
+	col, err := s.collection()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(ads))
+	docs := make([]interface{}, len(ads))
+	for i, ad := range ads {
+		if ad.ID.IsZero() {
+			ad.ID = primitive.NewObjectID()
+		}
+		ids[i] = ad.ID.Hex()
+		docs[i] = ad
+	}
+	if atomic {
+		if err := s.insertAtomically(ctx, col, docs); err != nil {
+			return nil, err
+		}
+		recordChange(ctx)
+		return ids, nil
+	}
+
+	// Unordered inserts store every valid ad of a batch despite failures
+	stored := make([]string, len(ads))
+	var errs []error
+	for start := 0; start < len(docs); start += cfg.BulkBatchSize {
+		end := min(start+cfg.BulkBatchSize, len(docs))
+		_, err := col.InsertMany(ctx, docs[start:end], options.InsertMany().SetOrdered(false))
+		var writeErr mongo.BulkWriteException
+		if err != nil && !errors.As(err, &writeErr) {
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		copy(stored[start:end], ids[start:end])
+		for _, failed := range writeErr.WriteErrors {
+			stored[start+failed.Index] = ""
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if slices.ContainsFunc(stored, func(id string) bool { return id != "" }) {
+		recordChange(ctx)
+	}
+	return stored, errors.Join(errs...)
+}
+
+// insertAtomically inserts docs in batches within a transaction.
+func (s *MongoAdStore) insertAtomically(ctx context.Context, col *mongo.Collection, docs []interface{}) error {
+	client, err := mongoConn.Client()
+	if err != nil {
+		return err
+	}
+	session, err := client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.Background())
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		for start := 0; start < len(docs); start += cfg.BulkBatchSize {
+			end := min(start+cfg.BulkBatchSize, len(docs))
+			if _, err := col.InsertMany(sc, docs[start:end]); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	var cmdErr mongo.CommandError
+	switch {
+	case errors.As(err, &cmdErr) && cmdErr.Code == illegalOperationCode:
+		// Transactions require a replica set
+		return fmt.Errorf("%w: %v", ErrAtomicUnsupported, err)
+	case mongo.IsDuplicateKeyError(err):
+		return ErrAdConflict
+	}
+	return err
+}
+
+func (s *MongoAdStore) FindActiveAds(ctx context.Context, now time.Time, query AdQuery, page Page) ([]AdItem, error) {
+	items := []AdItem{}
+	// MongoDB treats a limit of 0 as no limit
+	if page.Limit == 0 {
+		return items, nil
+	}
+
+	col, err := s.collection()
+	if err != nil {
+		return nil, err
+	}
+
+	// Sort, skip and limit in the database and only fetch the displayed fields
+	opts := options.Find().
+		SetSort(bson.D{{Key: "endAt", Value: 1}, {Key: "_id", Value: 1}}).
+		SetProjection(bson.M{"title": 1, "endAt": 1}).
+		SetSkip(int64(page.Offset))
+	if page.Limit > 0 {
+		opts.SetLimit(int64(page.Limit))
+	}
+
+	filter := buildAdFilter(now, query)
+	if page.After != nil {
+		filter["$or"] = []bson.M{
+			{"endAt": bson.M{"$gt": page.After.EndAt}},
+			{"endAt": page.After.EndAt, "_id": bson.M{"$gt": page.After.ID}},
+		}
+	}
+
+	// Apply filter in db
+	cursor, err := col.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	if err := cursor.All(ctx, &items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (s *MongoAdStore) NextChange(ctx context.Context, now time.Time, query AdQuery) (time.Time, error) {
+	col, err := s.collection()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// The first active ad to end
+	var ending Advertisement
+	opts := options.FindOne().SetSort(bson.D{{Key: "endAt", Value: 1}}).SetProjection(bson.M{"startAt": 1, "endAt": 1})
+	err = col.FindOne(ctx, buildAdFilter(now, query), opts).Decode(&ending)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return time.Time{}, err
+	}
+
+	// The first ad to start
+	var starting Advertisement
+	filter := buildAdFilter(now, query)
+	filter["startAt"] = bson.M{"$gt": now}
+	opts = options.FindOne().SetSort(bson.D{{Key: "startAt", Value: 1}}).SetProjection(bson.M{"startAt": 1, "endAt": 1})
+	err = col.FindOne(ctx, filter, opts).Decode(&starting)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return time.Time{}, err
+	}
+
+	now = storedTime(now)
+	var next time.Time
+	for _, ad := range []Advertisement{ending, starting} {
+		if !ad.EndAt.IsZero() {
+			next = earliest(next, nextChange(ad, now))
+		}
+	}
+	return next, nil
+}
+
+func (s *MongoAdStore) FindLiveAds(ctx context.Context, now time.Time) ([]Advertisement, error) {
+	col, err := s.collection()
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := col.Find(ctx, bson.M{"endAt": bson.M{"$gte": now}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	ads := []Advertisement{}
+	if err := cursor.All(ctx, &ads); err != nil {
+		return nil, err
+	}
+	return ads, nil
+}
+
+func (s *MongoAdStore) CountActiveAds(ctx context.Context, now time.Time) (int64, error) {
+	col, err := s.collection()
+	if err != nil {
+		return 0, err
+	}
+	return col.CountDocuments(ctx, bson.M{
+		"startAt": bson.M{"$lte": now},
+		"endAt":   bson.M{"$gte": now},
+		"status":  bson.M{"$ne": AdPending},
+	})
+}
+
+func (s *MongoAdStore) GetAd(ctx context.Context, id string) (Advertisement, error) {
+	var ad Advertisement
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ad, ErrInvalidID
+	}
+	col, err := s.collection()
+	if err != nil {
+		return ad, err
+	}
+	err = col.FindOne(ctx, bson.M{"_id": oid}).Decode(&ad)
+	if err == mongo.ErrNoDocuments {
+		return ad, ErrAdNotFound
+	}
+	return ad, err
+}
+
+func (s *MongoAdStore) UpdateAd(ctx context.Context, id string, ad Advertisement) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrInvalidID
+	}
+	col, err := s.collection()
+	if err != nil {
+		return err
+	}
+	ad.ID = oid
+	res, err := col.ReplaceOne(ctx, bson.M{"_id": oid}, ad)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrAdNotFound
+	}
+	recordChange(ctx)
+	return nil
+}
+
+func (s *MongoAdStore) ApproveAd(ctx context.Context, id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrInvalidID
+	}
+	col, err := s.collection()
+	if err != nil {
+		return err
+	}
+	res, err := col.UpdateOne(ctx, bson.M{"_id": oid}, bson.M{"$set": bson.M{"status": AdApproved}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrAdNotFound
+	}
+	recordChange(ctx)
+	return nil
+}
+
+func (s *MongoAdStore) DeleteAd(ctx context.Context, id string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrInvalidID
+	}
+	col, err := s.collection()
+	if err != nil {
+		return err
+	}
+	res, err := col.DeleteOne(ctx, bson.M{"_id": oid})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrAdNotFound
+	}
+	recordChange(ctx)
+	return nil
+}
+
+// adsRevisionID is the _id of the document of the watch state collection
+// counting the writes to the ads collection. Host names cannot contain ':'.
+const adsRevisionID = "ads:revision"
+
+// recordChange increments the revision polled by the AdWatcher of every instance,
+// once a write to the ads collection succeeded. The counter is shared, so
+// instances do not compare their clocks, and it also counts deleted ads.
+func recordChange(ctx context.Context) {
+	client, err := mongoConn.Client()
+	if err == nil {
+		// The write is done even if the client of the request went away
+		ctx, cancel := withRequestTimeout(context.WithoutCancel(ctx))
+		defer cancel()
+		col := client.Database(cfg.DBName).Collection(cfg.WatchStateCollectionName)
+		_, err = col.UpdateOne(ctx, bson.M{"_id": adsRevisionID}, bson.M{"$inc": bson.M{"revision": 1}}, options.Update().SetUpsert(true))
+	}
+	if err != nil {
+		// Other instances still see the change at their next periodic rebuild
+		slog.Warn("failed to record a change of ads", "error", err)
+	}
+}
+
+// buildAdFilter constructs the MongoDB query selecting approved ads active at
+// now with at least one condition matching query.
+func buildAdFilter(now time.Time, query AdQuery) bson.M {
+	// Construct age query
+	ageFilter := bson.M{}
+	if query.Age != nil {
+		ageFilter = bson.M{
+			"ageStart": bson.M{"$lte": *query.Age},
+			"ageEnd":   bson.M{"$gte": *query.Age},
+		}
+	}
+
+	// Construct gender query
+	genderFilter := bson.M{}
+	if query.Gender != "" {
+		genderFilter = bson.M{
+			"$or": []bson.M{
+				{"gender": bson.M{"$in": []Gender{query.Gender}}},
+				{"gender": nil}, // Unset field
+			},
+		}
+	}
+
+	// Construct country query
+	countryFilter := bson.M{}
+	if query.Country != "" {
+		countryFilter = bson.M{
+			"$or": []bson.M{
+				{"country": bson.M{"$in": []Country{query.Country}}},
+				{"country": nil}, // Unset field
+			},
+		}
+	}
+
+	// Construct region and city queries
+	regionFilter := bson.M{}
+	if query.Region != "" {
+		regionFilter = bson.M{
+			"$or": []bson.M{
+				{"region": bson.M{"$in": []Region{query.Region}}},
+				{"region": nil}, // Unset field
+			},
+		}
+	}
+	cityFilter := bson.M{}
+	if query.City != "" {
+		cityFilter = bson.M{
+			"$or": []bson.M{
+				{"city": bson.M{"$in": []City{query.City}}},
+				{"city": nil}, // Unset field
+			},
+		}
+	}
+
+	// Construct platform query
+	platformFilter := bson.M{}
+	if query.Platform != "" {
+		platformFilter = bson.M{
+			"$or": []bson.M{
+				{"platform": bson.M{"$in": []Platform{query.Platform}}},
+				{"platform": nil}, // Unset field
+			},
+		}
+	}
+
+	// Combine all condition filters into a single filter for $elemMatch
+	return bson.M{
+		"startAt": bson.M{"$lte": now},
+		"endAt":   bson.M{"$gte": now},
+		// Ads stored before approvals have no status
+		"status": bson.M{"$ne": AdPending},
+		"conditions": bson.M{
+			"$elemMatch": bson.M{
+				"$and": []bson.M{ageFilter, genderFilter, countryFilter, regionFilter, cityFilter, platformFilter},
+			},
+		},
+	}
+}
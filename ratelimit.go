@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RateLimit configures a token bucket: Burst tokens at most, refilled at Rate tokens per second.
+type RateLimit struct {
+	Rate  float64 `json:"rate" yaml:"rate"`
+	Burst int     `json:"burst" yaml:"burst"`
+}
+
+// RateDecision is the outcome of taking a token from a bucket.
+type RateDecision struct {
+	Allowed   bool
+	Remaining int
+	// ResetAfter is the time until the bucket is full again.
+	ResetAfter time.Duration
+	// RetryAfter is the time until a token is available, when not allowed.
+	RetryAfter time.Duration
+}
+
+// RateLimiter holds the token buckets of the clients.
+type RateLimiter interface {
+	// Take removes a token from the bucket of key if one is available.
+	Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateDecision, error)
+}
+
+// rateLimiter is the limiter used by the rateLimit middleware, selected at startup.
+var rateLimiter RateLimiter
+
+// newRateLimiter returns the limiter selected by the configuration.
+func newRateLimiter() RateLimiter {
+	if cfg.RateLimitStore == "mongo" {
+		return NewMongoRateLimiter()
+	}
+	return NewMemoryRateLimiter()
+}
+
+// refill returns the tokens of a bucket last updated at updated.
+func refill(tokens float64, updated time.Time, limit RateLimit, now time.Time) float64 {
+	elapsed := now.Sub(updated).Seconds()
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	return math.Min(float64(limit.Burst), tokens+elapsed*limit.Rate)
+}
+
+// decide builds the decision for a bucket holding tokens after the request.
+func decide(allowed bool, tokens float64, limit RateLimit) RateDecision {
+	d := RateDecision{
+		Allowed:    allowed,
+		Remaining:  int(math.Floor(tokens)),
+		ResetAfter: seconds((float64(limit.Burst) - tokens) / limit.Rate),
+	}
+	if !allowed {
+		d.RetryAfter = seconds((1 - tokens) / limit.Rate)
+	}
+	return d
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	limit   RateLimit
+}
+
+// MemoryRateLimiter is a RateLimiter keeping buckets in process memory.
+type MemoryRateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewMemoryRateLimiter returns a RateLimiter with in-process state.
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{buckets: map[string]*bucket{}}
+}
+
+func (l *MemoryRateLimiter) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateDecision, error) {
+	if err := ctx.Err(); err != nil {
+		return RateDecision{}, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = refill(b.tokens, b.updated, limit, now)
+	b.updated = now
+	b.limit = limit
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return decide(allowed, b.tokens, limit), nil
+}
+
+// sweep drops the full buckets once a minute so idle clients do not use memory.
+func (l *MemoryRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if refill(b.tokens, b.updated, b.limit, now) >= float64(b.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// MongoRateLimiter is a RateLimiter sharing buckets between instances through MongoDB.
+type MongoRateLimiter struct{}
+
+// NewMongoRateLimiter returns a RateLimiter with state in MongoDB.
+func NewMongoRateLimiter() *MongoRateLimiter {
+	return &MongoRateLimiter{}
+}
+
+// rateLimitTTL is how long an idle bucket is kept in MongoDB.
+const rateLimitTTL = time.Hour
+
+func (l *MongoRateLimiter) collection() (*mongo.Collection, error) {
+	client, err := mongoConn.Client()
+	if err != nil {
+		return nil, err
+	}
+	return client.Database(cfg.DBName).Collection(cfg.RateLimitCollectionName), nil
+}
+
+// EnsureIndexes creates the TTL index removing idle buckets.
+func (l *MongoRateLimiter) EnsureIndexes(ctx context.Context) error {
+	col, err := l.collection()
+	if err != nil {
+		return err
+	}
+	_, err = col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "updatedAt", Value: 1}},
+		Options: options.Index().SetName("updatedAt_1").SetExpireAfterSeconds(int32(rateLimitTTL.Seconds())),
+	})
+	return err
+}
+
+func (l *MongoRateLimiter) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (RateDecision, error) {
+	col, err := l.collection()
+	if err != nil {
+		return RateDecision{}, err
+	}
+
+	// Refill and take a token atomically, starting from a full bucket
+	burst := float64(limit.Burst)
+	elapsed := bson.M{"$divide": bson.A{bson.M{"$subtract": bson.A{now, bson.M{"$ifNull": bson.A{"$updatedAt", now}}}}, 1000}}
+	update := bson.A{
+		bson.M{"$set": bson.M{
+			"tokens": bson.M{"$min": bson.A{burst, bson.M{"$add": bson.A{
+				bson.M{"$ifNull": bson.A{"$tokens", burst}},
+				bson.M{"$multiply": bson.A{bson.M{"$max": bson.A{elapsed, 0}}, limit.Rate}},
+			}}}},
+			"updatedAt": now,
+		}},
+		bson.M{"$set": bson.M{"allowed": bson.M{"$gte": bson.A{"$tokens", 1}}}},
+		bson.M{"$set": bson.M{"tokens": bson.M{"$cond": bson.A{"$allowed", bson.M{"$subtract": bson.A{"$tokens", 1}}, "$tokens"}}}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var doc struct {
+		Tokens  float64 `bson:"tokens"`
+		Allowed bool    `bson:"allowed"`
+	}
+	err = col.FindOneAndUpdate(ctx, bson.M{"_id": key}, update, opts).Decode(&doc)
+	if err != nil {
+		return RateDecision{}, err
+	}
+	return decide(doc.Allowed, doc.Tokens, limit), nil
+}
+
+// rateLimitByIP enforces the limit configured for the matched route on the
+// IP address of the client. It runs before authentication so requests with
+// invalid keys are limited before their key is looked up.
+func rateLimitByIP(c *gin.Context) {
+	limitClient(c, "ip:"+c.ClientIP())
+}
+
+// rateLimitByKey enforces the limit configured for the matched route on the
+// API key of the request, when authentication found one.
+func rateLimitByKey(c *gin.Context) {
+	v, ok := c.Get(apiKeyKey)
+	if !ok {
+		c.Next()
+		return
+	}
+	key := v.(APIKey)
+	if key.ID.IsZero() {
+		limitClient(c, "key:"+key.Name)
+		return
+	}
+	limitClient(c, "key:"+key.ID.Hex())
+}
+
+// limitClient takes a token from the bucket of client for the matched route.
+func limitClient(c *gin.Context, client string) {
+	route := c.Request.Method + " " + c.FullPath()
+	limit, ok := cfg.RateLimits[route]
+	// A zero burst disables the limit of the route
+	if !ok || limit.Burst == 0 || rateLimiter == nil {
+		c.Next()
+		return
+	}
+
+	decision, err := rateLimiter.Take(c.Request.Context(), route+"|"+client, limit, time.Now())
+	if err != nil {
+		// Do not reject clients because the shared state is unavailable
+		requestLog(c).Warn("rate limiter unavailable", "error", err)
+		c.Next()
+		return
+	}
+
+	c.Header("X-RateLimit-Limit", strconv.Itoa(limit.Burst))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+	c.Header("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(decision.ResetAfter.Seconds()))))
+	if !decision.Allowed {
+		c.Header("Retry-After", strconv.Itoa(max(1, int(math.Ceil(decision.RetryAfter.Seconds())))))
+		respondError(c, http.StatusTooManyRequests, CodeRateLimited, "rate limit exceeded")
+		return
+	}
+	c.Next()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Role is a set of permissions attached to an API key.
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"
+	RoleEditor   Role = "editor"
+	RoleApprover Role = "approver"
+	RoleAdmin    Role = "admin"
+)
+
+// Permission is an action on a resource of the API.
+type Permission string
+
+const (
+	PermReadAds    Permission = "ads:read"
+	PermCreateAds  Permission = "ads:create"
+	PermUpdateAds  Permission = "ads:update"
+	PermApproveAds Permission = "ads:approve"
+	PermDeleteAds  Permission = "ads:delete"
+	PermManageKeys Permission = "keys:manage"
+)
+
+// roles lists every role, each one granting the permissions of the previous ones.
+var roles = []Role{RoleViewer, RoleEditor, RoleApprover, RoleAdmin}
+
+// rolePermissions maps each role to the permissions it grants.
+var rolePermissions = map[Role][]Permission{
+	RoleViewer:   {PermReadAds},
+	RoleEditor:   {PermReadAds, PermCreateAds, PermUpdateAds},
+	RoleApprover: {PermReadAds, PermCreateAds, PermUpdateAds, PermApproveAds, PermDeleteAds},
+	RoleAdmin:    {PermReadAds, PermCreateAds, PermUpdateAds, PermApproveAds, PermDeleteAds, PermManageKeys},
+}
+
+func (r Role) IsValid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+// HasPermission reports whether one of the roles grants perm.
+func HasPermission(roles []Role, perm Permission) bool {
+	for _, role := range roles {
+		if slices.Contains(rolePermissions[role], perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// rolesGranting returns the roles granting perm.
+func rolesGranting(perm Permission) []string {
+	var names []string
+	for _, role := range roles {
+		if slices.Contains(rolePermissions[role], perm) {
+			names = append(names, string(role))
+		}
+	}
+	return names
+}
+
+// requirePermission rejects requests whose API key has no role granting perm.
+// It must run after requireAPIKey.
+func requirePermission(perm Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.MustGet(apiKeyKey).(APIKey)
+		if HasPermission(key.Roles, perm) {
+			c.Next()
+			return
+		}
+		message := fmt.Sprintf("API key lacks permission %s, granted by roles %s", perm, strings.Join(rolesGranting(perm), ", "))
+		respondError(c, http.StatusForbidden, CodeForbidden, message)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/csv"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// regionsCSV is the ISO 3166-2 table of the subdivisions of the countries, at every level: code and name.
+//
+//go:embed regions.csv
+var regionsCSV string
+
+// citiesCSV is the reference table of the cities that can be targeted: code, ISO 3166-2 region and English name.
+//
+//go:embed cities.csv
+var citiesCSV string
+
+var (
+	// regions maps the code of every known region to its name.
+	regions map[Region]string
+	// cities maps the code of every known city to its region.
+	cities map[City]Region
+	// cityAliases maps the upper-case names of the cities to their code.
+	cityAliases map[string]City
+	// cityCountries lists the countries having cities in the table, sorted.
+	cityCountries []Country
+)
+
+func init() {
+	regions = map[Region]string{}
+	for _, record := range readReferenceTable(regionsCSV, "regions.csv") {
+		regions[Region(record[0])] = record[1]
+	}
+	cities = map[City]Region{}
+	cityAliases = map[string]City{}
+	for _, record := range readReferenceTable(citiesCSV, "cities.csv") {
+		cities[City(record[0])] = Region(record[1])
+		cityAliases[strings.ToUpper(record[2])] = City(record[0])
+		if country := Region(record[1]).Country(); !slices.Contains(cityCountries, country) {
+			cityCountries = append(cityCountries, country)
+		}
+	}
+	slices.Sort(cityCountries)
+}
+
+// HasCities reports whether the cities of the country are in the reference table.
+// Conditions can only target cities of those countries.
+func (c Country) HasCities() bool {
+	return slices.Contains(cityCountries, c)
+}
+
+// citiesCoverage describes the countries whose cities can be targeted, for error messages.
+func citiesCoverage() string {
+	names := make([]string, len(cityCountries))
+	for i, c := range cityCountries {
+		names[i] = string(c)
+	}
+	return "city targeting is only available in " + strings.Join(names, ", ")
+}
+
+// readReferenceTable returns the records of an embedded CSV table without its header.
+func readReferenceTable(table, name string) [][]string {
+	records, err := csv.NewReader(strings.NewReader(table)).ReadAll()
+	if err != nil {
+		panic("invalid " + name + ": " + err.Error())
+	}
+	return records[1:]
+}
+
+// ParseRegion returns the region with the ISO 3166-2 code s, in any case.
+// Unknown values are reported by IsValid.
+func ParseRegion(s string) Region {
+	return Region(strings.ToUpper(strings.TrimSpace(s)))
+}
+
+// IsValid reports whether r is a region of the reference table.
+func (r Region) IsValid() bool {
+	_, ok := regions[r]
+	return ok
+}
+
+// Country returns the country of the region, the prefix of its ISO 3166-2 code.
+func (r Region) Country() Country {
+	country, _, _ := strings.Cut(string(r), "-")
+	return Country(country)
+}
+
+// ParseCity returns the city with the code or English name s, in any case.
+// Unknown values are returned in lower case and reported by IsValid.
+func ParseCity(s string) City {
+	s = strings.TrimSpace(s)
+	if code, ok := cityAliases[strings.ToUpper(s)]; ok {
+		return code
+	}
+	return City(strings.ToLower(s))
+}
+
+// IsValid reports whether c is a city of the reference table.
+func (c City) IsValid() bool {
+	_, ok := cities[c]
+	return ok
+}
+
+// Region returns the region of the city, or "" if it is unknown.
+func (c City) Region() Region {
+	return cities[c]
+}
+
+// completeGeo adds to a condition targeting cities without listing regions the
+// regions of its cities, and to a condition targeting regions without listing
+// countries the countries of its regions. Searches by country then only match
+// the conditions of that country. Empty lists of regions or cities are removed,
+// as they would only match searches without a region or city.
+func completeGeo(cond *Condition) {
+	if len(cond.City) == 0 {
+		cond.City = nil
+	} else if len(cond.Region) == 0 {
+		cond.Region = parentsOf(cond.City, City.Region)
+	}
+	if len(cond.Region) == 0 {
+		cond.Region = nil
+	} else if cond.Country == nil {
+		cond.Country = parentsOf(cond.Region, Region.Country)
+	}
+}
+
+// completeGeo sets the region and country implied by the city and region of a
+// search, and reports false if they contradict the ones of the search.
+func (q *AdQuery) completeGeo() bool {
+	if q.City != "" {
+		if q.Region == "" {
+			q.Region = q.City.Region()
+		} else if q.Region != q.City.Region() {
+			return false
+		}
+	}
+	if q.Region != "" {
+		if q.Country == "" {
+			q.Country = q.Region.Country()
+		} else if q.Country != q.Region.Country() {
+			return false
+		}
+	}
+	return true
+}
+
+// parentsOf returns the distinct known parents of list, in order.
+func parentsOf[T, P comparable](list []T, parent func(T) P) []P {
+	var zero P
+	parents := []P{}
+	for _, v := range list {
+		if p := parent(v); p != zero && !slices.Contains(parents, p) {
+			parents = append(parents, p)
+		}
+	}
+	return parents
+}
+
+// validateGeo checks that the regions and cities of a condition found at path are
+// known and within its countries and regions, and that every country and region
+// of a condition targeting regions or cities contains one of them. The condition
+// is checked as stored, once normalized, but errors point into its lists as given.
+func validateGeo(path string, cond Condition) ValidationErrors {
+	var errs ValidationErrors
+	stored := cond
+	stored.Country = ExpandCountries(cond.Country)
+	completeGeo(&stored)
+
+	for i, r := range cond.Region {
+		field := fmt.Sprintf("%s.region[%d]", path, i)
+		if !r.IsValid() {
+			errs.add(field, "must be an ISO 3166-2 region of the reference table")
+		} else if !slices.Contains(stored.Country, r.Country()) {
+			errs.add(field, "must be in a country of the condition")
+		}
+	}
+	for i, c := range cond.City {
+		field := fmt.Sprintf("%s.city[%d]", path, i)
+		if !c.IsValid() {
+			errs.add(field, "must be a city of the reference table; %s", citiesCoverage())
+		} else if len(cond.Region) > 0 && !slices.Contains(cond.Region, c.Region()) {
+			errs.add(field, "must be in a region of the condition")
+		} else if len(cond.Region) == 0 && !slices.Contains(stored.Country, c.Region().Country()) {
+			// The regions of the condition are those of its cities
+			errs.add(field, "must be in a country of the condition")
+		}
+	}
+
+	// Without a region in a known country, the condition would match all of it
+	// for searches without a region but none of it for searches with one
+	hasRegion := func(c Country) bool {
+		return !c.IsValid() || slices.ContainsFunc(stored.Region, func(r Region) bool { return r.Country() == c })
+	}
+	if stored.Region != nil {
+		for i, c := range cond.Country {
+			field := fmt.Sprintf("%s.country[%d]", path, i)
+			if members, ok := countryGroups[c]; ok {
+				if slices.ContainsFunc(members, func(m Country) bool { return !hasRegion(m) }) {
+					errs.add(field, "must only have countries containing a region of the condition")
+				}
+			} else if !hasRegion(c) {
+				errs.add(field, "must contain a region of the condition")
+			}
+		}
+	}
+	if cond.City != nil {
+		for i, r := range cond.Region {
+			field := fmt.Sprintf("%s.region[%d]", path, i)
+			switch {
+			case !r.IsValid():
+			case !r.Country().HasCities():
+				errs.add(field, "has no city in the reference table; %s", citiesCoverage())
+			case !slices.ContainsFunc(cond.City, func(c City) bool { return c.Region() == r }):
+				errs.add(field, "must contain a city of the condition")
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// adCache holds the responses of the public ad search, created at startup.
+var adCache *ResponseCache
+
+// ResponseCache keeps public search responses until the ads they depend on
+// change: an entry expires when an ad matching its query starts or ends, and
+// every entry is dropped by Clear when ads are written.
+// A nil *ResponseCache caches nothing.
+type ResponseCache struct {
+	// TTL bounds the lifetime of entries with no upcoming ad boundary.
+	TTL time.Duration
+	// Size is the maximum number of entries.
+	Size int
+
+	mu         sync.Mutex
+	entries    map[string]cacheEntry
+	generation uint64
+}
+
+type cacheEntry struct {
+	ads       DisplayAds
+	expiresAt time.Time
+}
+
+// NewResponseCache returns an empty cache of at most size entries kept up to ttl.
+func NewResponseCache(size int, ttl time.Duration) *ResponseCache {
+	return &ResponseCache{TTL: ttl, Size: size, entries: map[string]cacheEntry{}}
+}
+
+// responseCacheKey returns the cache key of a search, independent of how its parameters were written.
+func responseCacheKey(query AdQuery, page Page) string {
+	age := ""
+	if query.Age != nil {
+		age = fmt.Sprint(*query.Age)
+	}
+	cursor := ""
+	if page.After != nil {
+		cursor = EncodeCursor(*page.After)
+	}
+	return fmt.Sprintf("%s|%s|%s|%s|%s|%s|%d|%d|%s", age, query.Gender, query.Country, query.Region, query.City, query.Platform, page.Offset, page.Limit, cursor)
+}
+
+// Get returns the response cached under key if it has not expired at now,
+// and the generation to pass to Set when it is missing.
+func (c *ResponseCache) Get(key string, now time.Time) (DisplayAds, uint64, bool) {
+	if c == nil {
+		return DisplayAds{}, 0, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if ok && now.Before(entry.expiresAt) {
+		responseCacheRequests.WithLabelValues("hit").Inc()
+		return entry.ads, c.generation, true
+	}
+	if ok {
+		delete(c.entries, key)
+	}
+	responseCacheRequests.WithLabelValues("miss").Inc()
+	return DisplayAds{}, c.generation, false
+}
+
+// Set caches ads under key until expiresAt, or for TTL from now if expiresAt is zero
+// or later. It does nothing if the cache was cleared since generation was returned by Get,
+// as ads may have been computed from the previous data.
+func (c *ResponseCache) Set(key string, generation uint64, ads DisplayAds, now, expiresAt time.Time) {
+	if c == nil {
+		return
+	}
+	expiresAt = earliest(expiresAt, now.Add(c.TTL))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation || c.Size <= 0 {
+		return
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.Size {
+		c.evict(now)
+	}
+	c.entries[key] = cacheEntry{ads: ads, expiresAt: expiresAt}
+}
+
+// evict removes the expired entries, or an arbitrary entry if none has expired. c.mu must be held.
+func (c *ResponseCache) evict(now time.Time) {
+	for key, entry := range c.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < c.Size {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
+
+// Clear drops every entry, after ads changed.
+func (c *ResponseCache) Clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	clear(c.entries)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newServer returns an HTTP server for handler with the timeouts of the configuration.
+func newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         cfg.ListenAddr,
+		Handler:      handler,
+		ReadTimeout:  time.Duration(cfg.ReadTimeout),
+		WriteTimeout: time.Duration(cfg.WriteTimeout),
+		IdleTimeout:  time.Duration(cfg.IdleTimeout),
+	}
+}
+
+// withRequestTimeout returns a context bounded by the configured request timeout, if any.
+func withRequestTimeout(parent context.Context) (context.Context, context.CancelFunc) {
+	if cfg.RequestTimeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, time.Duration(cfg.RequestTimeout))
+}
+
+// requestDeadline bounds the time spent on a request, including its database calls.
+// The request context is also canceled when the client disconnects.
+func requestDeadline(c *gin.Context) {
+	ctx, cancel := withRequestTimeout(c.Request.Context())
+	defer cancel()
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+}
+
+// serve accepts connections on ln until ctx is cancelled, then stops accepting,
+// waits up to the shutdown timeout for in-flight requests to finish and calls
+// closers in order to release background workers and connections.
+func serve(ctx context.Context, srv *http.Server, ln net.Listener, closers ...func(context.Context) error) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-serveErr:
+		// The server stopped on its own
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+
+	var errs []error
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := <-serveErr; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		errs = append(errs, err)
+	}
+	for _, closer := range closers {
+		if err := closer(shutdownCtx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/bits"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IndexedAdStore is an AdStore answering the public search from an in-process
+// index of the live ads of Store, so searches do not reach the database.
+// The index is rebuilt every Refresh and shortly after each write; until the
+// first build succeeds, searches go to Store. Every other method uses Store.
+type IndexedAdStore struct {
+	Store AdStore
+	// Refresh is the time between two periodic rebuilds.
+	Refresh time.Duration
+
+	index   atomic.Pointer[servingIndex]
+	rebuild chan struct{}
+	// onRebuild is called after every successful rebuild.
+	onRebuild func()
+
+	mu      sync.Mutex
+	started bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewIndexedAdStore returns a store serving searches over store from an index rebuilt every refresh.
+func NewIndexedAdStore(store AdStore, refresh time.Duration) *IndexedAdStore {
+	return &IndexedAdStore{
+		Store:   store,
+		Refresh: refresh,
+		rebuild: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+func (s *IndexedAdStore) InsertAd(ctx context.Context, ad Advertisement) (string, error) {
+	id, err := s.Store.InsertAd(ctx, ad)
+	if err == nil {
+		s.Invalidate()
+	}
+	return id, err
+}
+
+func (s *IndexedAdStore) InsertAds(ctx context.Context, ads []Advertisement, atomic bool) ([]string, error) {
+	ids, err := s.Store.InsertAds(ctx, ads, atomic)
+	if slices.ContainsFunc(ids, func(id string) bool { return id != "" }) {
+		s.Invalidate()
+	}
+	return ids, err
+}
+
+func (s *IndexedAdStore) FindActiveAds(ctx context.Context, now time.Time, query AdQuery, page Page) ([]AdItem, error) {
+	index := s.index.Load()
+	if index == nil {
+		return s.Store.FindActiveAds(ctx, now, query, page)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return index.find(now, query, page), nil
+}
+
+func (s *IndexedAdStore) NextChange(ctx context.Context, now time.Time, query AdQuery) (time.Time, error) {
+	index := s.index.Load()
+	if index == nil {
+		return s.Store.NextChange(ctx, now, query)
+	}
+	if err := ctx.Err(); err != nil {
+		return time.Time{}, err
+	}
+	return index.nextChange(now, query), nil
+}
+
+func (s *IndexedAdStore) FindLiveAds(ctx context.Context, now time.Time) ([]Advertisement, error) {
+	return s.Store.FindLiveAds(ctx, now)
+}
+
+func (s *IndexedAdStore) CountActiveAds(ctx context.Context, now time.Time) (int64, error) {
+	return s.Store.CountActiveAds(ctx, now)
+}
+
+func (s *IndexedAdStore) GetAd(ctx context.Context, id string) (Advertisement, error) {
+	return s.Store.GetAd(ctx, id)
+}
+
+func (s *IndexedAdStore) UpdateAd(ctx context.Context, id string, ad Advertisement) error {
+	err := s.Store.UpdateAd(ctx, id, ad)
+	if err == nil {
+		s.Invalidate()
+	}
+	return err
+}
+
+func (s *IndexedAdStore) ApproveAd(ctx context.Context, id string) error {
+	err := s.Store.ApproveAd(ctx, id)
+	if err == nil {
+		s.Invalidate()
+	}
+	return err
+}
+
+func (s *IndexedAdStore) DeleteAd(ctx context.Context, id string) error {
+	err := s.Store.DeleteAd(ctx, id)
+	if err == nil {
+		s.Invalidate()
+	}
+	return err
+}
+
+// Rebuild replaces the index with one built from the ads of Store live at the current time.
+// The previous index keeps serving when it fails.
+func (s *IndexedAdStore) Rebuild(ctx context.Context) error {
+	now := time.Now()
+	ads, err := s.Store.FindLiveAds(ctx, now)
+	if err != nil {
+		return err
+	}
+	index := newServingIndex(ads)
+	s.index.Store(index)
+	if s.onRebuild != nil {
+		s.onRebuild()
+	}
+	servingIndexSize.Set(float64(len(index.ads)))
+	servingIndexBuilt.Set(float64(now.UnixMilli()) / 1000)
+	return nil
+}
+
+// Invalidate asks the background worker to rebuild the index.
+// Requests made while a rebuild is pending are coalesced.
+func (s *IndexedAdStore) Invalidate() {
+	select {
+	case s.rebuild <- struct{}{}:
+	default:
+	}
+}
+
+// Start builds the index in the background and keeps it fresh until Close.
+func (s *IndexedAdStore) Start() {
+	s.mu.Lock()
+	s.started = true
+	s.mu.Unlock()
+	go s.run()
+}
+
+func (s *IndexedAdStore) run() {
+	defer close(s.done)
+
+	// A rebuild runs to completion however long it takes, and only Close cancels it.
+	// Ticks missed meanwhile are dropped, so rebuilds never pile up.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-s.stop
+		cancel()
+	}()
+
+	ticker := time.NewTicker(s.Refresh)
+	defer ticker.Stop()
+	for {
+		if err := s.Rebuild(ctx); err != nil {
+			slog.Warn("failed to rebuild serving index", "error", err)
+		}
+
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		case <-s.rebuild:
+		}
+	}
+}
+
+// Close stops rebuilding the index.
+func (s *IndexedAdStore) Close(ctx context.Context) error {
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+
+	s.mu.Lock()
+	started := s.started
+	s.mu.Unlock()
+	if !started {
+		return nil
+	}
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// servingIndex is an immutable snapshot of the live ads, with the conditions
+// of every ad indexed by gender, country, region, city, platform and age.
+type servingIndex struct {
+	// ads are sorted by endAt and ID, like search results.
+	ads []Advertisement
+	// condAd maps each indexed condition to its position in ads.
+	condAd []int
+	// all holds every condition.
+	all      bitset
+	gender   targetIndex[Gender]
+	country  targetIndex[Country]
+	region   targetIndex[Region]
+	city     targetIndex[City]
+	platform targetIndex[Platform]
+	// ageBounds are the first ages of consecutive age ranges; ageRanges[i]
+	// holds the conditions covering every age from ageBounds[i] to the next bound.
+	ageBounds []int
+	ageRanges []bitset
+}
+
+// newServingIndex indexes ads.
+func newServingIndex(ads []Advertisement) *servingIndex {
+	// Pending ads are not served
+	ads = slices.DeleteFunc(slices.Clone(ads), func(ad Advertisement) bool { return !ad.Approved() })
+	sort.Slice(ads, func(i, j int) bool {
+		return cursorOf(ads[i]).Less(cursorOf(ads[j]))
+	})
+
+	var conds []Condition
+	index := &servingIndex{ads: ads}
+	for i, ad := range ads {
+		for _, cond := range ad.Conditions {
+			conds = append(conds, cond)
+			index.condAd = append(index.condAd, i)
+		}
+	}
+
+	index.all = newBitset(len(conds))
+	index.gender = newTargetIndex[Gender](len(conds))
+	index.country = newTargetIndex[Country](len(conds))
+	index.region = newTargetIndex[Region](len(conds))
+	index.city = newTargetIndex[City](len(conds))
+	index.platform = newTargetIndex[Platform](len(conds))
+	bounds := map[int]bool{}
+	for i, cond := range conds {
+		index.all.set(i)
+		index.gender.add(i, cond.Gender)
+		index.country.add(i, cond.Country)
+		index.region.add(i, cond.Region)
+		index.city.add(i, cond.City)
+		index.platform.add(i, cond.Platform)
+		bounds[cond.AgeStart] = true
+		bounds[cond.AgeEnd+1] = true
+	}
+	index.gender.seal()
+	index.country.seal()
+	index.region.seal()
+	index.city.seal()
+	index.platform.seal()
+
+	// Conditions cover either all or none of the ages between two bounds
+	for bound := range bounds {
+		index.ageBounds = append(index.ageBounds, bound)
+	}
+	sort.Ints(index.ageBounds)
+	for _, age := range index.ageBounds {
+		covering := newBitset(len(conds))
+		for i, cond := range conds {
+			if cond.AgeStart <= age && cond.AgeEnd >= age {
+				covering.set(i)
+			}
+		}
+		index.ageRanges = append(index.ageRanges, covering)
+	}
+	return index
+}
+
+// find returns the page of ads active at now with at least one condition matching query,
+// as MongoAdStore.FindActiveAds does.
+func (idx *servingIndex) find(now time.Time, query AdQuery, page Page) []AdItem {
+	items := []AdItem{}
+	if page.Limit == 0 {
+		return items
+	}
+	now = storedTime(now)
+	matched := idx.match(query)
+
+	// Skip the results up to the cursor
+	start := 0
+	if page.After != nil {
+		start = sort.Search(len(idx.ads), func(i int) bool {
+			return page.After.Less(cursorOf(idx.ads[i]))
+		})
+	}
+
+	skip := page.Offset
+	for i := start; i < len(idx.ads); i++ {
+		ad := idx.ads[i]
+		if !matched.has(i) || ad.StartAt.After(now) || ad.EndAt.Before(now) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		items = append(items, AdItem{ID: ad.ID, Title: ad.Title, EndAt: ad.EndAt})
+		if page.Limit > 0 && len(items) == page.Limit {
+			break
+		}
+	}
+	return items
+}
+
+// nextChange returns the earliest time after now at which an ad with a condition
+// matching query starts or stops being active, or the zero time if there is none.
+func (idx *servingIndex) nextChange(now time.Time, query AdQuery) time.Time {
+	now = storedTime(now)
+	var next time.Time
+	idx.match(query).each(func(i int) {
+		next = earliest(next, nextChange(idx.ads[i], now))
+	})
+	return next
+}
+
+// match returns the positions in ads of the ads with at least one condition matching query.
+func (idx *servingIndex) match(query AdQuery) bitset {
+	conds := slices.Clone(idx.all)
+	if query.Age != nil {
+		conds.and(idx.ages(*query.Age))
+	}
+	if query.Gender != "" {
+		conds.and(idx.gender.lookup(query.Gender))
+	}
+	if query.Country != "" {
+		conds.and(idx.country.lookup(query.Country))
+	}
+	if query.Region != "" {
+		conds.and(idx.region.lookup(query.Region))
+	}
+	if query.City != "" {
+		conds.and(idx.city.lookup(query.City))
+	}
+	if query.Platform != "" {
+		conds.and(idx.platform.lookup(query.Platform))
+	}
+
+	matched := newBitset(len(idx.ads))
+	conds.each(func(i int) {
+		matched.set(idx.condAd[i])
+	})
+	return matched
+}
+
+// ages returns the conditions whose age range contains age.
+func (idx *servingIndex) ages(age int) bitset {
+	i := sort.SearchInts(idx.ageBounds, age+1) - 1
+	if i < 0 {
+		return newBitset(len(idx.condAd))
+	}
+	return idx.ageRanges[i]
+}
+
+// targetIndex maps the values of a targeting field to the conditions matching them.
+type targetIndex[T comparable] struct {
+	// values holds, for each listed value, the conditions listing it or not restricting the field.
+	values map[T]bitset
+	// any holds the conditions not restricting the field, which match every value.
+	any bitset
+}
+
+func newTargetIndex[T comparable](n int) targetIndex[T] {
+	return targetIndex[T]{values: map[T]bitset{}, any: newBitset(n)}
+}
+
+// add indexes condition i targeting list. A nil list matches any value,
+// while an empty non-nil list matches none, as in Condition.Matches.
+func (t targetIndex[T]) add(i int, list []T) {
+	if list == nil {
+		t.any.set(i)
+		return
+	}
+	for _, v := range list {
+		b, ok := t.values[v]
+		if !ok {
+			b = newBitset(len(t.any) * 64)
+			t.values[v] = b
+		}
+		b.set(i)
+	}
+}
+
+// seal adds the unrestricted conditions to every value once all conditions are added.
+func (t targetIndex[T]) seal() {
+	for _, b := range t.values {
+		b.or(t.any)
+	}
+}
+
+// lookup returns the conditions matching v.
+func (t targetIndex[T]) lookup(v T) bitset {
+	if b, ok := t.values[v]; ok {
+		return b
+	}
+	return t.any
+}
+
+// bitset is a set of small non-negative integers.
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) set(i int) {
+	b[i/64] |= 1 << (i % 64)
+}
+
+func (b bitset) has(i int) bool {
+	return b[i/64]&(1<<(i%64)) != 0
+}
+
+// and removes from b the integers missing from other.
+func (b bitset) and(other bitset) {
+	for i := range b {
+		b[i] &= other[i]
+	}
+}
+
+// or adds to b the integers of other.
+func (b bitset) or(other bitset) {
+	for i := range b {
+		b[i] |= other[i]
+	}
+}
+
+// each calls f with every integer of b in increasing order.
+func (b bitset) each(f func(i int)) {
+	for w, word := range b {
+		for word != 0 {
+			f(w*64 + bits.TrailingZeros64(word))
+			word &= word - 1
+		}
+	}
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"context"
-	"log"
-	"os"
+	"log/slog"
+	"math/rand"
 	"sync"
 	"time"
 
@@ -11,50 +11,286 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var (
-	client     *mongo.Client
-	clientOnce sync.Once
-	clientErr  error
-	dbCol      *mongo.Collection
+// ConnState is the state of the connection to MongoDB.
+type ConnState int
+
+const (
+	Connecting ConnState = iota
+	Connected
+	Disconnected
 )
 
-func getClient() (*mongo.Client, error) {
-	clientOnce.Do(func() {
-		client, clientErr = connectToMongoDB()
-	})
+func (s ConnState) String() string {
+	switch s {
+	case Connected:
+		return "connected"
+	case Disconnected:
+		return "disconnected"
+	default:
+		return "connecting"
+	}
+}
+
+// mongoConn is the connection used by the MongoDB store, created at startup.
+var mongoConn *ConnectionManager
+
+// ConnectionManager keeps a MongoDB connection open, reconnecting in the
+// background with exponential backoff when it is lost.
+type ConnectionManager struct {
+	mu       sync.RWMutex
+	client   *mongo.Client
+	col      *mongo.Collection
+	state    ConnState
+	lastErr  error
+	lastPing time.Time
+	retryAt  time.Time
+	// pingFailures counts the consecutive failed pings.
+	pingFailures int
+
+	// onConnect is called after every successful connection, with a context
+	// canceled by Close.
+	onConnect func(ctx context.Context)
+
+	started bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewConnectionManager returns a manager for the MongoDB deployment in the configuration.
+func NewConnectionManager() *ConnectionManager {
+	return &ConnectionManager{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// Client returns the connected client without waiting for a reconnection.
+func (m *ConnectionManager) Client() (*mongo.Client, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.state != Connected {
+		return nil, m.unavailable()
+	}
+	return m.client, nil
+}
+
+// Collection returns the ads collection without waiting for a reconnection.
+func (m *ConnectionManager) Collection() (*mongo.Collection, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.state != Connected {
+		return nil, m.unavailable()
+	}
+	return m.col, nil
+}
+
+// unavailable returns the error reported while disconnected. m.mu must be held.
+func (m *ConnectionManager) unavailable() error {
+	return &StoreUnavailableError{RetryAfter: time.Until(m.retryAt), Err: m.lastErr}
+}
+
+// ConnStatus reports the state of a ConnectionManager.
+type ConnStatus struct {
+	State ConnState
+	// LastError is the error of the last failed connection attempt or ping.
+	LastError error
+	// LastPing is the time of the last successful connection or ping.
+	LastPing time.Time
+}
+
+// Status returns the current connection status.
+func (m *ConnectionManager) Status() ConnStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return ConnStatus{State: m.state, LastError: m.lastErr, LastPing: m.lastPing}
+}
+
+// Connect makes a single connection attempt. A previous client is only
+// disconnected once replaced, so its pending operations can complete.
+func (m *ConnectionManager) Connect() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ConnectTimeout))
+	defer cancel()
+	client, col, err := connectToMongoDB(ctx)
 
-	// If clientErr is not nil (indicating an error occurred previously), attempt to reconnect
-	if clientErr != nil {
-		client, clientErr = connectToMongoDB()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.state = Disconnected
+		m.lastErr = err
+		return err
 	}
+	if previous := m.client; previous != nil {
+		// Disconnect waits for the connections in use to be returned
+		go previous.Disconnect(context.Background())
+	}
+	m.client, m.col = client, col
+	m.state = Connected
+	m.lastErr = nil
+	m.lastPing = time.Now()
+	m.pingFailures = 0
+	return nil
+}
 
-	return client, clientErr
+// Start connects in the background and keeps the connection alive until Close.
+func (m *ConnectionManager) Start() {
+	m.mu.Lock()
+	m.started = true
+	m.mu.Unlock()
+	go m.run()
 }
 
-func connectToMongoDB() (*mongo.Client, error) {
+func (m *ConnectionManager) run() {
+	defer close(m.done)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-m.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	backoff := time.Duration(cfg.ReconnectMinBackoff)
+	for {
+		if m.Status().State != Connected {
+			if err := m.Connect(); err != nil {
+				delay := jitter(backoff)
+				backoff = nextBackoff(backoff, time.Duration(cfg.ReconnectMaxBackoff))
+				m.mu.Lock()
+				m.retryAt = time.Now().Add(delay)
+				m.mu.Unlock()
+				slog.Warn("failed to connect to MongoDB", "retryIn", delay.String(), "error", err)
+				if !m.sleep(delay) {
+					return
+				}
+				continue
+			}
+			backoff = time.Duration(cfg.ReconnectMinBackoff)
+			slog.Info("connected to MongoDB")
+			if m.onConnect != nil {
+				m.onConnect(ctx)
+			}
+		}
+
+		if !m.sleep(time.Duration(cfg.PingInterval)) {
+			return
+		}
+		m.ping()
+	}
+}
+
+// maxPingFailures is the number of consecutive failed pings after which the connection is lost.
+const maxPingFailures = 3
+
+// ping checks the connection and marks it lost after maxPingFailures
+// consecutive failures. The client is kept until a reconnection replaces it.
+func (m *ConnectionManager) ping() {
+	m.mu.RLock()
+	client := m.client
+	m.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ConnectTimeout))
+	defer cancel()
+	err := client.Ping(ctx, nil)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err == nil {
+		m.lastPing = time.Now()
+		m.pingFailures = 0
+		return
+	}
+	m.lastErr = err
+	m.pingFailures++
+	if m.pingFailures < maxPingFailures {
+		slog.Warn("MongoDB ping failed", "failures", m.pingFailures, "error", err)
+		return
+	}
+	slog.Warn("lost connection to MongoDB", "error", err)
+	m.state = Disconnected
+	m.retryAt = time.Now()
+}
+
+// sleep waits for d and reports false if the manager was closed meanwhile.
+func (m *ConnectionManager) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-m.stop:
+		return false
+	}
+}
+
+// Close stops reconnecting and disconnects the client.
+func (m *ConnectionManager) Close(ctx context.Context) error {
+	select {
+	case <-m.stop:
+	default:
+		close(m.stop)
+	}
+
+	// Wait for a pending connection attempt to finish
+	m.mu.RLock()
+	started := m.started
+	m.mu.RUnlock()
+	if started {
+		select {
+		case <-m.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	m.mu.Lock()
+	client := m.client
+	m.client, m.col = nil, nil
+	m.state = Disconnected
+	m.mu.Unlock()
+
+	if client == nil {
+		return nil
+	}
+	return client.Disconnect(ctx)
+}
+
+// nextBackoff doubles the reconnection delay up to limit.
+func nextBackoff(current, limit time.Duration) time.Duration {
+	return min(current*2, limit)
+}
+
+// jitter randomizes d by up to 20% so instances do not reconnect in lockstep.
+func jitter(d time.Duration) time.Duration {
+	return d - time.Duration(rand.Int63n(int64(d)/5+1))
+}
+
+func connectToMongoDB(ctx context.Context) (*mongo.Client, *mongo.Collection, error) {
 	// Set MongoDB connection options
-	clientOptions := options.Client().ApplyURI("mongodb://localhost:27017").
-		SetConnectTimeout(10 * time.Second).
-		SetMaxPoolSize(100)
+	clientOptions := options.Client().ApplyURI(cfg.MongoURI).
+		SetConnectTimeout(time.Duration(cfg.ConnectTimeout)).
+		SetServerSelectionTimeout(time.Duration(cfg.ConnectTimeout)).
+		SetMaxPoolSize(cfg.MaxPoolSize).
+		SetMonitor(mongoCommandMonitor).
+		SetPoolMonitor(mongoPoolMonitor)
 
 	// Connect to MongoDB
-	client, err := mongo.Connect(context.Background(), clientOptions)
+	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
-		log.Fatalf("Failed to connect to MongoDB: %v", err)
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Ping the MongoDB server
-	err = client.Ping(context.Background(), nil)
+	err = client.Ping(ctx, nil)
 	if err != nil {
-		return nil, err
+		client.Disconnect(context.Background())
+		return nil, nil, err
 	}
 
 	// Access a database
-	database := client.Database(os.Getenv("DB_NAME"))
+	database := client.Database(cfg.DBName)
 
 	// Access a collection
-	dbCol = database.Collection(os.Getenv("COLLECTION_NAME"))
-
-	return client, nil
+	return client, database.Collection(cfg.CollectionName), nil
 }
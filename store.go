@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// ErrAdNotFound is returned when no ad exists for the given ID.
+	ErrAdNotFound = errors.New("ad not found")
+	// ErrInvalidID is returned when an ad ID is not a valid identifier.
+	ErrInvalidID = errors.New("invalid ad id")
+	// ErrAdConflict is returned when an ad with the same ID already exists.
+	ErrAdConflict = errors.New("ad already exists")
+	// ErrStoreUnavailable is returned when the backing database cannot be reached.
+	ErrStoreUnavailable = errors.New("failed to connect to database")
+	// ErrAtomicUnsupported is returned when the database cannot insert ads in a transaction.
+	ErrAtomicUnsupported = errors.New("atomic inserts are not supported by the database")
+)
+
+// StoreUnavailableError is returned while the database cannot be reached.
+// It matches ErrStoreUnavailable with errors.Is.
+type StoreUnavailableError struct {
+	// RetryAfter is the time until the next reconnection attempt.
+	RetryAfter time.Duration
+	// Err is the cause of the last failed connection attempt, if any.
+	Err error
+}
+
+func (e *StoreUnavailableError) Error() string {
+	if e.Err == nil {
+		return ErrStoreUnavailable.Error()
+	}
+	return ErrStoreUnavailable.Error() + ": " + e.Err.Error()
+}
+
+func (e *StoreUnavailableError) Unwrap() []error {
+	return []error{ErrStoreUnavailable, e.Err}
+}
+
+// AdQuery holds the targeting parameters of a public ad search.
+// Zero values mean the parameter was not supplied.
+type AdQuery struct {
+	Age      *int
+	Gender   Gender
+	Country  Country
+	Region   Region
+	City     City
+	Platform Platform
+}
+
+// Page selects a window of the search results, which are sorted by endAt and ID.
+type Page struct {
+	// After, when set, only selects results sorted after this position.
+	After  *PageCursor
+	Offset int
+	// Limit is the maximum number of results; a negative value means no limit.
+	Limit int
+}
+
+// PageCursor is the sort position of a search result.
+type PageCursor struct {
+	EndAt time.Time
+	ID    primitive.ObjectID
+}
+
+// Less reports whether p sorts before other.
+func (p PageCursor) Less(other PageCursor) bool {
+	if !p.EndAt.Equal(other.EndAt) {
+		return p.EndAt.Before(other.EndAt)
+	}
+	return bytes.Compare(p.ID[:], other.ID[:]) < 0
+}
+
+// storedTime returns t with the precision of the datetimes compared by MongoDB.
+func storedTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Millisecond)
+}
+
+// nextChange returns the earliest time after now at which ad starts or stops
+// being active, or the zero time if it has ended. now must be a storedTime.
+func nextChange(ad Advertisement, now time.Time) time.Time {
+	if ad.StartAt.After(now) {
+		return ad.StartAt
+	}
+	if !ad.EndAt.Before(now) {
+		// Ads are active up to the last millisecond of endAt
+		return ad.EndAt.Add(time.Millisecond)
+	}
+	return time.Time{}
+}
+
+// earliest returns the earlier of a and b, ignoring zero times.
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// AdStore is the persistence layer used by the HTTP handlers.
+// Every method stops and returns the context error when ctx is done.
+type AdStore interface {
+	// InsertAd stores a new ad and returns its generated ID.
+	InsertAd(ctx context.Context, ad Advertisement) (string, error)
+	// InsertAds stores new ads and returns their generated IDs in order. When
+	// atomic is set, either every ad is stored or none is and no ID is returned.
+	// Otherwise, on failure, the IDs of the ads stored anyway are returned, with
+	// empty IDs for the others.
+	InsertAds(ctx context.Context, ads []Advertisement, atomic bool) ([]string, error)
+	// FindActiveAds returns the page of approved ads active at now with at least
+	// one condition matching query, sorted by endAt and ID.
+	FindActiveAds(ctx context.Context, now time.Time, query AdQuery, page Page) ([]AdItem, error)
+	// NextChange returns the earliest time after now at which an approved ad with at least
+	// one condition matching query starts or stops being active, or the zero time
+	// if there is none. Results of FindActiveAds for query do not change before it.
+	NextChange(ctx context.Context, now time.Time, query AdQuery) (time.Time, error)
+	// FindLiveAds returns every ad whose time window has not ended at now,
+	// including ads that have not started yet.
+	FindLiveAds(ctx context.Context, now time.Time) ([]Advertisement, error)
+	// CountActiveAds returns the number of approved ads whose time window contains now.
+	CountActiveAds(ctx context.Context, now time.Time) (int64, error)
+	// GetAd returns the ad with the given ID.
+	GetAd(ctx context.Context, id string) (Advertisement, error)
+	// UpdateAd replaces the ad with the given ID.
+	UpdateAd(ctx context.Context, id string, ad Advertisement) error
+	// ApproveAd marks the ad with the given ID as approved.
+	ApproveAd(ctx context.Context, id string) error
+	// DeleteAd removes the ad with the given ID.
+	DeleteAd(ctx context.Context, id string) error
+}
+
+// adStore is the store used by the handlers, selected at startup.
+var adStore AdStore
+
+// newAdStore returns the store selected by the configuration.
+func newAdStore() AdStore {
+	if cfg.Store == "memory" {
+		return NewMemoryAdStore()
+	}
+	if cfg.ServingIndexRefresh > 0 {
+		return NewIndexedAdStore(NewMongoAdStore(), time.Duration(cfg.ServingIndexRefresh))
+	}
+	return NewMongoAdStore()
+}
+
+// baseAdStore returns the store holding the ads, behind any serving index.
+func baseAdStore() AdStore {
+	if indexed, ok := adStore.(*IndexedAdStore); ok {
+		return indexed.Store
+	}
+	return adStore
+}
@@ -1,6 +1,10 @@
 package main
 
-import "time"
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 type Gender string
 
@@ -19,6 +23,12 @@ const (
 	Thailand      Country = "TH"
 )
 
+// Region is the ISO 3166-2 code of a subdivision of a country, such as JP-13.
+type Region string
+
+// City is the code of a city of the reference table, such as tokyo.
+type City string
+
 type Platform string
 
 const (
@@ -34,23 +44,47 @@ type Condition struct {
 	Gender   []Gender   `json:"gender" bson:"gender"`
 	Country  []Country  `json:"country" bson:"country"`
 	Platform []Platform `json:"platform" bson:"platform"`
+	// Region and City narrow Country; they are omitted from JSON when unset.
+	Region []Region `json:"region,omitempty" bson:"region"`
+	City   []City   `json:"city,omitempty" bson:"city"`
 }
 
+// AdStatus is the review state of an ad.
+type AdStatus string
+
+const (
+	// AdPending ads wait for an approver and are not served.
+	AdPending AdStatus = "pending"
+	// AdApproved ads are served during their time window.
+	AdApproved AdStatus = "approved"
+)
+
 // Advertisement represents data about a record advertisement.
 type Advertisement struct {
-	Title      string      `json:"title" bson:"title"`
-	StartAt    time.Time   `json:"startAt" bson:"startAt"`
-	EndAt      time.Time   `json:"endAt" bson:"endAt"`
-	Conditions []Condition `json:"conditions" bson:"conditions"`
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Title      string             `json:"title" bson:"title"`
+	StartAt    time.Time          `json:"startAt" bson:"startAt"`
+	EndAt      time.Time          `json:"endAt" bson:"endAt"`
+	Conditions []Condition        `json:"conditions" bson:"conditions"`
+	// Status is set by the server: every write makes the ad pending until approved.
+	Status AdStatus `json:"status" bson:"status,omitempty"`
+}
+
+// Approved reports whether ad may be served. Ads stored before approvals
+// existed have no status and stay served.
+func (ad Advertisement) Approved() bool {
+	return ad.Status != AdPending
 }
 
 // define the sructure of Public API response
 type DisplayAds struct {
-	Items []AdItem `json:"items" bson:"items"`
+	Items      []AdItem `json:"items" bson:"items"`
+	NextCursor string   `json:"nextCursor,omitempty" bson:"-"`
 }
 
 // AdItem represents data about a record of an ad to be displayed.
 type AdItem struct {
-	Title string    `json:"title" bson:"title"`
-	EndAt time.Time `json:"endAt" bson:"endAt"`
+	ID    primitive.ObjectID `json:"-" bson:"_id"`
+	Title string             `json:"title" bson:"title"`
+	EndAt time.Time          `json:"endAt" bson:"endAt"`
 }
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"strconv"
 	"strings"
 	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 func (g Gender) IsValid() bool {
@@ -16,38 +20,31 @@ func (g Gender) IsValid() bool {
 	}
 }
 
+// UnmarshalJSON normalizes the case of the gender.
+// Unknown values are reported by ValidateAdvertisement.
 func (g *Gender) UnmarshalJSON(data []byte) error {
 	var s string
 	if err := json.Unmarshal(data, &s); err != nil {
 		return err
 	}
-	gender := Gender(strings.ToUpper(s))
-	if !gender.IsValid() {
-		return errors.New("invalid gender value")
-	}
-	*g = gender
+	*g = Gender(strings.ToUpper(s))
 	return nil
 }
 
+// IsValid reports whether c is the alpha-2 code of an ISO 3166-1 country.
 func (c Country) IsValid() bool {
-	switch c {
-	case Taiwan, Japan, United_States, Korea, Thailand:
-		return true
-	default:
-		return false
-	}
+	_, ok := countries[c]
+	return ok
 }
 
+// UnmarshalJSON normalizes the country to its alpha-2 code, as ParseCountry does.
+// Unknown values are reported by ValidateAdvertisement.
 func (c *Country) UnmarshalJSON(data []byte) error {
 	var s string
 	if err := json.Unmarshal(data, &s); err != nil {
 		return err
 	}
-	country := Country(strings.ToUpper(s))
-	if !country.IsValid() {
-		return errors.New("invalid gender value")
-	}
-	*c = country
+	*c = ParseCountry(s)
 	return nil
 }
 
@@ -60,16 +57,36 @@ func (p Platform) IsValid() bool {
 	}
 }
 
-func (p *Platform) UnmarshalJSON(data []byte) error {
+// UnmarshalJSON normalizes the case of the region.
+// Unknown values are reported by ValidateAdvertisement.
+func (r *Region) UnmarshalJSON(data []byte) error {
 	var s string
 	if err := json.Unmarshal(data, &s); err != nil {
 		return err
 	}
-	platform := Platform(strings.ToLower(s))
-	if !platform.IsValid() {
-		return errors.New("invalid gender value")
+	*r = ParseRegion(s)
+	return nil
+}
+
+// UnmarshalJSON normalizes the city to its code, as ParseCity does.
+// Unknown values are reported by ValidateAdvertisement.
+func (c *City) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
 	}
-	*p = platform
+	*c = ParseCity(s)
+	return nil
+}
+
+// UnmarshalJSON normalizes the case of the platform.
+// Unknown values are reported by ValidateAdvertisement.
+func (p *Platform) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	*p = Platform(strings.ToLower(s))
 	return nil
 }
 
@@ -79,6 +96,16 @@ func ParseTime(s string) (time.Time, error) {
 	return time.Parse(layout, s)
 }
 
+// normalizeConditions expands the country groups of conditions into their members
+// and completes their geographic targeting, as completeGeo does. It runs once the
+// conditions are validated, so that errors point into the lists as submitted.
+func normalizeConditions(conditions []Condition) {
+	for i := range conditions {
+		conditions[i].Country = ExpandCountries(conditions[i].Country)
+		completeGeo(&conditions[i])
+	}
+}
+
 // Customizes the JSON marshalling behavior for the Advertisement struct
 func (ad Advertisement) MarshalJSON() ([]byte, error) {
 	// Create a map to hold the serialized data
@@ -88,6 +115,12 @@ func (ad Advertisement) MarshalJSON() ([]byte, error) {
 		"endAt":      ad.EndAt.Format("2006-01-02T15:04:05.000Z"),
 		"conditions": ad.Conditions,
 	}
+	if !ad.ID.IsZero() {
+		data["id"] = ad.ID.Hex()
+	}
+	if ad.Status != "" {
+		data["status"] = ad.Status
+	}
 
 	// Marshal the map to JSON
 	return json.Marshal(data)
@@ -104,3 +137,30 @@ func (ad AdItem) MarshalJSON() ([]byte, error) {
 	// Marshal the map to JSON
 	return json.Marshal(data)
 }
+
+// EncodeCursor returns the opaque pagination cursor for a sort position.
+func EncodeCursor(pos PageCursor) string {
+	raw := strconv.FormatInt(pos.EndAt.UnixMilli(), 10) + "_" + pos.ID.Hex()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// DecodeCursor parses a pagination cursor returned by EncodeCursor.
+func DecodeCursor(s string) (PageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return PageCursor{}, err
+	}
+	millis, hex, ok := strings.Cut(string(raw), "_")
+	if !ok {
+		return PageCursor{}, errors.New("malformed cursor")
+	}
+	ms, err := strconv.ParseInt(millis, 10, 64)
+	if err != nil {
+		return PageCursor{}, err
+	}
+	id, err := primitive.ObjectIDFromHex(hex)
+	if err != nil {
+		return PageCursor{}, err
+	}
+	return PageCursor{EndAt: time.UnixMilli(ms).UTC(), ID: id}, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	minAge         = 1
+	maxAge         = 100
+	maxTitleLength = 100
+)
+
+// FieldError describes an invalid field of a request body.
+type FieldError struct {
+	// Field is the JSON path of the field, such as conditions[1].country[0].
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors lists every invalid field of a request body.
+type ValidationErrors []FieldError
+
+func (v ValidationErrors) Error() string {
+	messages := make([]string, len(v))
+	for i, e := range v {
+		messages[i] = e.Field + " " + e.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (v *ValidationErrors) add(field, format string, args ...interface{}) {
+	*v = append(*v, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// ValidateAdvertisement checks every field of ad and returns all violations.
+func ValidateAdvertisement(ad Advertisement) ValidationErrors {
+	var errs ValidationErrors
+
+	if ad.Title == "" {
+		errs.add("title", "is required")
+	} else if n := utf8.RuneCountInString(ad.Title); n > maxTitleLength {
+		errs.add("title", "must be at most %d characters, got %d", maxTitleLength, n)
+	}
+
+	if ad.StartAt.IsZero() {
+		errs.add("startAt", "is required")
+	}
+	if ad.EndAt.IsZero() {
+		errs.add("endAt", "is required")
+	}
+	if !ad.StartAt.IsZero() && !ad.EndAt.IsZero() && !ad.StartAt.Before(ad.EndAt) {
+		errs.add("startAt", "must be before endAt")
+	}
+
+	for i, cond := range ad.Conditions {
+		errs = append(errs, validateCondition(fmt.Sprintf("conditions[%d]", i), cond)...)
+	}
+	return errs
+}
+
+// validateCondition checks every field of a condition found at path.
+func validateCondition(path string, cond Condition) ValidationErrors {
+	var errs ValidationErrors
+
+	if cond.AgeStart < minAge || cond.AgeStart > maxAge {
+		errs.add(path+".ageStart", "must be between %d and %d", minAge, maxAge)
+	}
+	if cond.AgeEnd < minAge || cond.AgeEnd > maxAge {
+		errs.add(path+".ageEnd", "must be between %d and %d", minAge, maxAge)
+	}
+	if cond.AgeStart > cond.AgeEnd {
+		errs.add(path+".ageStart", "must be less than or equal to ageEnd")
+	}
+
+	for i, g := range cond.Gender {
+		if !g.IsValid() {
+			errs.add(fmt.Sprintf("%s.gender[%d]", path, i), "must be one of %s, %s", Male, Female)
+		}
+	}
+	for i, c := range cond.Country {
+		if !c.IsValid() && !c.IsGroup() {
+			errs.add(fmt.Sprintf("%s.country[%d]", path, i), "must be an ISO 3166-1 country or a country group")
+		}
+	}
+	for i, p := range cond.Platform {
+		if !p.IsValid() {
+			errs.add(fmt.Sprintf("%s.platform[%d]", path, i), "must be one of %s, %s, %s", IOS, Android, Web)
+		}
+	}
+	return append(errs, validateGeo(path, cond)...)
+}